@@ -0,0 +1,314 @@
+package maptilecache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const DEFAULT_BOLT_STORE_PATH = "maptilecache.db"
+const DEFAULT_BOLT_STORE_TIMEOUT = 5 * time.Second
+
+// number of keys read per transaction while iterating
+const boltIterateBatchSize = 1000
+
+var boltTilesBucket = []byte("tiles")
+
+// BoltStore is a TileStore that keeps all tiles in a single bbolt file. Keys
+// are TileKey.String(), e.g. "osm/1/2/3", values hold the tile's format,
+// modtime and metadata followed by the tile's data.
+type BoltStore struct {
+	Path string
+	db   *bolt.DB
+}
+
+type BoltStoreConfig struct {
+	Path    string        // defaults to DEFAULT_BOLT_STORE_PATH
+	Timeout time.Duration // to wait for the file lock, defaults to DEFAULT_BOLT_STORE_TIMEOUT
+	NoSync  bool          // skip fsync after each write, faster but unsafe on power loss
+}
+
+type boltRecord struct {
+	Format  TileFormat `json:"format,omitempty"`
+	ModTime time.Time  `json:"modTime"`
+	Meta    *TileMeta  `json:"meta,omitempty"`
+}
+
+func NewBoltStore(config BoltStoreConfig) (*BoltStore, error) {
+	path := config.Path
+
+	if strings.TrimSpace(path) == "" {
+		path = DEFAULT_BOLT_STORE_PATH
+	}
+
+	timeout := config.Timeout
+
+	if timeout <= 0 {
+		timeout = DEFAULT_BOLT_STORE_TIMEOUT
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: timeout, NoSync: config.NoSync})
+
+	if err != nil {
+		return nil, errors.New("could not open bolt store [" + path + "], reason: " + err.Error())
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltTilesBucket)
+		return err
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{
+		Path: path,
+		db:   db,
+	}, nil
+}
+
+func encodeBoltValue(tile *StoredTile) ([]byte, error) {
+	modTime := tile.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	format := tile.Format
+	if len(tile.Data) == 0 {
+		format = ""
+	}
+
+	header, err := json.Marshal(boltRecord{
+		Format:  format,
+		ModTime: modTime,
+		Meta:    tile.Meta,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(header)+len(tile.Data))
+	n := binary.PutUvarint(value, uint64(len(header)))
+	value = append(value[:n], header...)
+
+	return append(value, tile.Data...), nil
+}
+
+// decodeBoltValue returns the record and the tile's data. The data refers to
+// the value and must be copied if it is used outside the transaction.
+func decodeBoltValue(value []byte) (*boltRecord, []byte, error) {
+	headerLength, n := binary.Uvarint(value)
+
+	if n <= 0 || uint64(len(value)-n) < headerLength {
+		return nil, nil, errors.New("invalid value in bolt store")
+	}
+
+	var record boltRecord
+	err := json.Unmarshal(value[n:n+int(headerLength)], &record)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &record, value[n+int(headerLength):], nil
+}
+
+func (s *BoltStore) Get(key TileKey) (*StoredTile, error) {
+	var tile *StoredTile
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltTilesBucket).Get([]byte(key.String()))
+
+		if value == nil {
+			return os.ErrNotExist
+		}
+
+		record, data, err := decodeBoltValue(value)
+
+		if err != nil {
+			return err
+		}
+
+		if len(data) == 0 {
+			return os.ErrNotExist
+		}
+
+		tile = &StoredTile{
+			Data:    append([]byte{}, data...),
+			Format:  record.Format,
+			Meta:    record.Meta,
+			ModTime: record.ModTime,
+		}
+
+		return nil
+	})
+
+	return tile, err
+}
+
+func (s *BoltStore) Put(key TileKey, tile *StoredTile) error {
+	value, err := encodeBoltValue(tile)
+
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTilesBucket).Put([]byte(key.String()), value)
+	})
+}
+
+func (s *BoltStore) Delete(key TileKey) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTilesBucket).Delete([]byte(key.String()))
+	})
+}
+
+func (s *BoltStore) Stat(key TileKey) (*TileInfo, error) {
+	var info *TileInfo
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltTilesBucket).Get([]byte(key.String()))
+
+		if value == nil {
+			return os.ErrNotExist
+		}
+
+		record, data, err := decodeBoltValue(value)
+
+		if err != nil {
+			return err
+		}
+
+		info = &TileInfo{
+			Key:     key,
+			Format:  record.Format,
+			Size:    int64(len(data)),
+			ModTime: record.ModTime,
+			Meta:    record.Meta,
+		}
+
+		return nil
+	})
+
+	return info, err
+}
+
+// Iterate reads the keys in batches, so fn may modify the store.
+func (s *BoltStore) Iterate(route []string, fn func(info TileInfo) error) error {
+	prefix := []byte(strings.Join(route, "/") + "/")
+	seek := prefix
+
+	for {
+		infos := []TileInfo{}
+		var next []byte
+
+		err := s.db.View(func(tx *bolt.Tx) error {
+			cursor := tx.Bucket(boltTilesBucket).Cursor()
+
+			for k, value := cursor.Seek(seek); k != nil && bytes.HasPrefix(k, prefix); k, value = cursor.Next() {
+				if len(infos) == boltIterateBatchSize {
+					next = append([]byte{}, k...)
+					return nil
+				}
+
+				key, valid := parseBoltKey(route, string(k))
+				if !valid {
+					continue
+				}
+
+				record, data, err := decodeBoltValue(value)
+				if err != nil {
+					continue
+				}
+
+				infos = append(infos, TileInfo{
+					Key:     key,
+					Format:  record.Format,
+					Size:    int64(len(data)),
+					ModTime: record.ModTime,
+					Meta:    record.Meta,
+				})
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			err = fn(info)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if next == nil {
+			return nil
+		}
+
+		seek = next
+	}
+}
+
+func parseBoltKey(route []string, key string) (TileKey, bool) {
+	segments := strings.Split(key, "/")
+
+	if len(segments) < len(route)+3 {
+		return TileKey{}, false
+	}
+
+	segments = segments[len(route):]
+	n := len(segments)
+
+	return TileKey{
+		Route:  route,
+		Params: segments[:n-3],
+		Z:      segments[n-3],
+		Y:      segments[n-2],
+		X:      segments[n-1],
+	}, true
+}
+
+// DeletePrefix removes all tiles of the route whose params start with params,
+// e.g. all tiles of one value of the first StructureParam.
+func (s *BoltStore) DeletePrefix(route []string, params []string) error {
+	prefix := []byte(strings.Join(append(append([]string{}, route...), params...), "/") + "/")
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltTilesBucket).Cursor()
+
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Seek(prefix) {
+			err := cursor.Delete()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Clear removes all tiles of the route.
+func (s *BoltStore) Clear(route []string) error {
+	return s.DeletePrefix(route, nil)
+}
+
+// Close closes the bolt file. Close the store after all caches using it have
+// been closed.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,265 @@
+package maptilecache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestBoltStore(t *testing.T) *BoltStore {
+	store, err := NewBoltStore(BoltStoreConfig{Path: filepath.Join(t.TempDir(), "tiles.db"), NoSync: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		store.Close()
+	})
+
+	return store
+}
+
+func TestBoltValue(t *testing.T) {
+	modTime := time.Date(2022, 3, 4, 5, 6, 7, 8, time.UTC)
+	meta := &TileMeta{ContentType: "image/png", ETag: `"abc"`, FetchedAt: modTime, OriginStatus: 200, Size: 4}
+
+	tests := []struct {
+		name   string
+		tile   *StoredTile
+		format TileFormat
+	}{
+		{
+			name:   "tile",
+			tile:   &StoredTile{Data: []byte("tile"), Format: TILE_FORMAT_PNG, Meta: meta, ModTime: modTime},
+			format: TILE_FORMAT_PNG,
+		},
+		{
+			name:   "tile without metadata",
+			tile:   &StoredTile{Data: []byte{0, 1, 2}, Format: TILE_FORMAT_MVT, ModTime: modTime},
+			format: TILE_FORMAT_MVT,
+		},
+		{
+			// metadata only, the format is dropped
+			name:   "negative entry",
+			tile:   &StoredTile{Format: TILE_FORMAT_PNG, Meta: &TileMeta{FetchedAt: modTime, OriginStatus: 404}, ModTime: modTime},
+			format: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := encodeBoltValue(test.tile)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			record, data, err := decodeBoltValue(value)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(data, test.tile.Data) {
+				t.Errorf("expected data %v, got %v", test.tile.Data, data)
+			}
+
+			if record.Format != test.format {
+				t.Errorf("expected format %q, got %q", test.format, record.Format)
+			}
+
+			if !record.ModTime.Equal(test.tile.ModTime) {
+				t.Errorf("expected modtime %s, got %s", test.tile.ModTime, record.ModTime)
+			}
+
+			if !reflect.DeepEqual(record.Meta, test.tile.Meta) {
+				t.Errorf("expected meta %+v, got %+v", test.tile.Meta, record.Meta)
+			}
+		})
+	}
+}
+
+func TestDecodeBoltValueInvalid(t *testing.T) {
+	value, err := encodeBoltValue(&StoredTile{Data: []byte("tile"), Format: TILE_FORMAT_PNG})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headerLength, n := binary.Uvarint(value)
+	truncated := value[:n+int(headerLength)-1]
+
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{name: "empty", value: []byte{}},
+		{name: "truncated length", value: []byte{0x80}},
+		{name: "truncated header", value: truncated},
+		{name: "header longer than value", value: []byte{10, '{', '}'}},
+		{name: "invalid header", value: []byte{2, 'n', 'o', 't', 'j', 's', 'o', 'n'}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if record, data, err := decodeBoltValue(test.value); err == nil {
+				t.Errorf("expected an error, got %+v, %v", record, data)
+			}
+		})
+	}
+}
+
+func TestParseBoltKey(t *testing.T) {
+	tests := []struct {
+		route    []string
+		key      string
+		expected TileKey
+		valid    bool
+	}{
+		{
+			route:    []string{"osm"},
+			key:      "osm/1/2/3",
+			expected: TileKey{Route: []string{"osm"}, Params: []string{}, Z: "1", Y: "2", X: "3"},
+			valid:    true,
+		},
+		{
+			route:    []string{"maps", "ofm"},
+			key:      "maps/ofm/2201/aero/4/5/6",
+			expected: TileKey{Route: []string{"maps", "ofm"}, Params: []string{"2201", "aero"}, Z: "4", Y: "5", X: "6"},
+			valid:    true,
+		},
+		{route: []string{"osm"}, key: "osm/2/3"},
+		{route: []string{"maps", "ofm"}, key: "maps/ofm/1/2"},
+	}
+
+	for _, test := range tests {
+		key, valid := parseBoltKey(test.route, test.key)
+
+		if valid != test.valid {
+			t.Errorf("parseBoltKey(%q): expected valid %t, got %t", test.key, test.valid, valid)
+			continue
+		}
+
+		if valid && !reflect.DeepEqual(key, test.expected) {
+			t.Errorf("parseBoltKey(%q): expected %+v, got %+v", test.key, test.expected, key)
+		}
+	}
+}
+
+func TestBoltStoreIterate(t *testing.T) {
+	store := newTestBoltStore(t)
+	count := boltIterateBatchSize + 5
+
+	for i := 0; i < count; i++ {
+		key := TileKey{Route: []string{"osm"}, Z: "12", Y: strconv.Itoa(i / 100), X: strconv.Itoa(i % 100)}
+
+		if err := store.Put(key, &StoredTile{Data: []byte("tile"), Format: TILE_FORMAT_PNG}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// must not be visited
+	if err := store.Put(TileKey{Route: []string{"osm2"}, Z: "1", Y: "0", X: "0"}, &StoredTile{Data: []byte("tile"), Format: TILE_FORMAT_PNG}); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+
+	// fn may modify the store
+	err := store.Iterate([]string{"osm"}, func(info TileInfo) error {
+		if seen[info.Key.String()] {
+			t.Errorf("[%s] visited twice", info.Key.String())
+		}
+		seen[info.Key.String()] = true
+
+		if info.Format != TILE_FORMAT_PNG || info.Size != 4 {
+			t.Errorf("[%s]: expected png with 4 Bytes, got %q with %d Bytes", info.Key.String(), info.Format, info.Size)
+		}
+
+		return store.Delete(info.Key)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != count {
+		t.Errorf("expected %d tiles, got %d", count, len(seen))
+	}
+
+	if _, err := store.Stat(TileKey{Route: []string{"osm2"}, Z: "1", Y: "0", X: "0"}); err != nil {
+		t.Errorf("expected the tile of the other route to be kept, got %s", err)
+	}
+}
+
+func TestBoltStoreDeletePrefix(t *testing.T) {
+	keys := []TileKey{
+		{Route: []string{"osm"}, Z: "1", Y: "0", X: "0"},
+		{Route: []string{"osm"}, Params: []string{"dark"}, Z: "1", Y: "0", X: "0"},
+		{Route: []string{"osm"}, Params: []string{"dark", "hd"}, Z: "1", Y: "0", X: "1"},
+		{Route: []string{"osm"}, Params: []string{"darker"}, Z: "1", Y: "0", X: "0"},
+		{Route: []string{"osm"}, Params: []string{"light"}, Z: "1", Y: "0", X: "0"},
+		{Route: []string{"osm2"}, Z: "1", Y: "0", X: "0"},
+		{Route: []string{"osm2"}, Params: []string{"dark"}, Z: "1", Y: "0", X: "0"},
+	}
+
+	tests := []struct {
+		name     string
+		route    []string
+		params   []string
+		expected []string
+	}{
+		{
+			name:     "route",
+			route:    []string{"osm"},
+			expected: []string{"osm2/1/0/0", "osm2/dark/1/0/0"},
+		},
+		{
+			name:     "route and params",
+			route:    []string{"osm"},
+			params:   []string{"dark"},
+			expected: []string{"osm/1/0/0", "osm/darker/1/0/0", "osm/light/1/0/0", "osm2/1/0/0", "osm2/dark/1/0/0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestBoltStore(t)
+
+			for _, key := range keys {
+				if err := store.Put(key, &StoredTile{Data: []byte("tile"), Format: TILE_FORMAT_PNG}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := store.DeletePrefix(test.route, test.params); err != nil {
+				t.Fatal(err)
+			}
+
+			kept := []string{}
+
+			for _, key := range keys {
+				_, err := store.Stat(key)
+
+				if err == nil {
+					kept = append(kept, key.String())
+				} else if !os.IsNotExist(err) {
+					t.Fatal(err)
+				}
+			}
+
+			sort.Strings(kept)
+
+			if !reflect.DeepEqual(kept, test.expected) {
+				t.Errorf("expected %v to be kept, got %v", test.expected, kept)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package maptilecache
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DEFAULT_BREAKER_OPEN_DURATION = 30 * time.Second
+
+type BreakerState int
+
+const (
+	BREAKER_CLOSED BreakerState = iota
+	BREAKER_OPEN
+	BREAKER_HALF_OPEN
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BREAKER_CLOSED:
+		return "closed"
+	case BREAKER_OPEN:
+		return "open"
+	case BREAKER_HALF_OPEN:
+		return "half-open"
+	}
+
+	return "unknown"
+}
+
+var errCircuitOpen = errors.New("circuit breaker is open, origin will not be requested")
+
+type breakerResult int
+
+const (
+	breakerSuccess breakerResult = iota
+	breakerFailure
+	breakerIgnore
+)
+
+// circuitBreaker stops requests to the origin after failureThreshold
+// consecutive failures. After openDuration it lets up to maxProbes requests
+// through (half-open), a successful probe closes the breaker again, a failed
+// probe reopens it. A failureThreshold <= 0 disables the breaker.
+type circuitBreaker struct {
+	state            BreakerState
+	failures         int
+	failureThreshold int
+	openDuration     time.Duration
+	openedAt         time.Time
+	maxProbes        int
+	probesInFlight   int
+	mutex            *sync.Mutex
+	onStateChange    func(from BreakerState, to BreakerState)
+}
+
+func newCircuitBreaker(failureThreshold int, openDuration time.Duration, maxProbes int, onStateChange func(from BreakerState, to BreakerState)) *circuitBreaker {
+	if openDuration <= 0 {
+		openDuration = DEFAULT_BREAKER_OPEN_DURATION
+	}
+
+	if maxProbes <= 0 {
+		maxProbes = 1
+	}
+
+	return &circuitBreaker{
+		state:            BREAKER_CLOSED,
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+		maxProbes:        maxProbes,
+		mutex:            &sync.Mutex{},
+		onStateChange:    onStateChange,
+	}
+}
+
+func (b *circuitBreaker) enabled() bool {
+	return b.failureThreshold > 0
+}
+
+func (b *circuitBreaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+
+	from := b.state
+	b.state = state
+
+	if b.onStateChange != nil {
+		b.onStateChange(from, state)
+	}
+}
+
+// allow reports whether a request may be sent to the origin. Every allowed
+// request must be reported back through done.
+func (b *circuitBreaker) allow() bool {
+	if !b.enabled() {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == BREAKER_OPEN && time.Since(b.openedAt) >= b.openDuration {
+		b.setState(BREAKER_HALF_OPEN)
+		b.probesInFlight = 0
+	}
+
+	switch b.state {
+	case BREAKER_OPEN:
+		return false
+	case BREAKER_HALF_OPEN:
+		if b.probesInFlight >= b.maxProbes {
+			return false
+		}
+		b.probesInFlight++
+	}
+
+	return true
+}
+
+func (b *circuitBreaker) done(result breakerResult) {
+	if !b.enabled() {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == BREAKER_HALF_OPEN && b.probesInFlight > 0 {
+		b.probesInFlight--
+	}
+
+	switch result {
+	case breakerSuccess:
+		b.failures = 0
+		b.setState(BREAKER_CLOSED)
+	case breakerFailure:
+		b.failures++
+
+		if b.state == BREAKER_HALF_OPEN || b.failures >= b.failureThreshold {
+			b.openedAt = time.Now()
+			b.setState(BREAKER_OPEN)
+		}
+	}
+}
+
+func (b *circuitBreaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state
+}
+
+func (b *circuitBreaker) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.enabled() {
+		return "disabled"
+	}
+
+	return b.state.String() + " (" + strconv.Itoa(b.failures) + " consecutive failures)"
+}
@@ -0,0 +1,299 @@
+package maptilecache
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+const DEFAULT_DISK_QUOTA_CHECK_INTERVAL = time.Minute
+
+// eviction continues until usage is this fraction of the limit, so that the
+// evictor does not run again on the next write
+const diskQuotaLowWatermark = 0.9
+
+var errEvictorStopped = errors.New("evictor stopped")
+
+type quotaEntry struct {
+	key        TileKey
+	size       int64
+	lastAccess time.Time
+}
+
+// diskQuota tracks the size and last access of every stored tile of a cache.
+// Access times are kept in memory, so they do not depend on the filesystem
+// recording atime. After a restart, tiles start out with their modtime.
+type diskQuota struct {
+	maxBytes     int64
+	minFreeBytes uint64
+	usagePath    string
+	entries      map[string]*quotaEntry
+	totalBytes   int64
+	mutex        *sync.Mutex
+	trigger      chan struct{}
+}
+
+func newDiskQuota(maxBytes int64, minFreeBytes uint64, usagePath string) *diskQuota {
+	return &diskQuota{
+		maxBytes:     maxBytes,
+		minFreeBytes: minFreeBytes,
+		usagePath:    usagePath,
+		entries:      make(map[string]*quotaEntry),
+		mutex:        &sync.Mutex{},
+		trigger:      make(chan struct{}, 1),
+	}
+}
+
+func (q *diskQuota) enabled() bool {
+	return q.maxBytes > 0 || q.minFreeBytes > 0
+}
+
+// add records a stored tile. If known is set, tiles that are already tracked
+// are left untouched, e.g. while scanning the store on startup.
+func (q *diskQuota) add(key TileKey, size int64, lastAccess time.Time, known bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	keyString := key.String()
+	entry, exists := q.entries[keyString]
+
+	if exists && known {
+		return
+	}
+
+	if exists {
+		q.totalBytes -= entry.size
+	}
+
+	q.entries[keyString] = &quotaEntry{
+		key:        key,
+		size:       size,
+		lastAccess: lastAccess,
+	}
+	q.totalBytes += size
+
+	if q.maxBytes > 0 && q.totalBytes > q.maxBytes {
+		select {
+		case q.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *diskQuota) touch(key string, lastAccess time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if entry, exists := q.entries[key]; exists {
+		entry.lastAccess = lastAccess
+	}
+}
+
+func (q *diskQuota) remove(key string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if entry, exists := q.entries[key]; exists {
+		q.totalBytes -= entry.size
+		delete(q.entries, key)
+	}
+}
+
+func (q *diskQuota) removePrefix(prefix string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for key, entry := range q.entries {
+		if strings.HasPrefix(key, prefix) {
+			q.totalBytes -= entry.size
+			delete(q.entries, key)
+		}
+	}
+}
+
+func (q *diskQuota) reset() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.entries = make(map[string]*quotaEntry)
+	q.totalBytes = 0
+}
+
+func (q *diskQuota) size() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.totalBytes
+}
+
+// bytesToFree returns how many bytes have to be evicted to get below the
+// limits again.
+func (q *diskQuota) bytesToFree() (int64, error) {
+	var bytes int64 = 0
+
+	if totalBytes := q.size(); q.maxBytes > 0 && totalBytes > q.maxBytes {
+		bytes = totalBytes - int64(float64(q.maxBytes)*diskQuotaLowWatermark)
+	}
+
+	if q.minFreeBytes > 0 {
+		usage, err := disk.Usage(q.usagePath)
+
+		if err != nil {
+			return bytes, err
+		}
+
+		if usage.Free < q.minFreeBytes {
+			missing := int64(q.minFreeBytes-usage.Free) + int64(float64(q.minFreeBytes)*(1-diskQuotaLowWatermark))
+
+			if missing > bytes {
+				bytes = missing
+			}
+		}
+	}
+
+	return bytes, nil
+}
+
+// victims returns the least recently accessed tiles that add up to at least
+// bytes.
+func (q *diskQuota) victims(bytes int64) []quotaEntry {
+	q.mutex.Lock()
+	entries := make([]quotaEntry, 0, len(q.entries))
+
+	for _, entry := range q.entries {
+		entries = append(entries, *entry)
+	}
+	q.mutex.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastAccess.Before(entries[j].lastAccess)
+	})
+
+	var freed int64 = 0
+
+	for i, entry := range entries {
+		if freed >= bytes {
+			return entries[:i]
+		}
+
+		freed += entry.size
+	}
+
+	return entries
+}
+
+// initEvictor scans the store for the cache's tiles and starts evicting the
+// least recently accessed tiles whenever MaxDiskBytes or MinFreeDiskBytes is
+// exceeded.
+func (c *Cache) initEvictor(interval time.Duration) {
+	if !c.quota.enabled() {
+		return
+	}
+
+	if interval <= 0 {
+		interval = DEFAULT_DISK_QUOTA_CHECK_INTERVAL
+	}
+
+	c.inFlight.Add(1)
+
+	go func() {
+		defer c.inFlight.Done()
+
+		start := time.Now()
+
+		err := c.Store.Iterate(c.Route, func(info TileInfo) error {
+			select {
+			case <-c.quit:
+				return errEvictorStopped
+			default:
+			}
+
+			if info.Format != "" {
+				c.quota.add(info.Key, info.Size, info.ModTime, true)
+			}
+
+			return nil
+		})
+
+		if err == errEvictorStopped {
+			return
+		} else if err != nil {
+			c.logWarn("Could not scan store for disk quota, reason: " + err.Error())
+		}
+
+		duration := time.Since(start)
+		c.logInfo("Disk quota initialized, cache uses " + strconv.FormatInt(c.quota.size(), 10) + " Bytes (took " + duration.String() + ")")
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			c.evict()
+
+			select {
+			case <-ticker.C:
+			case <-c.quota.trigger:
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (c *Cache) evict() {
+	bytes, err := c.quota.bytesToFree()
+
+	if err != nil {
+		c.logWarn("Could not check free disk space, reason: " + err.Error())
+	}
+
+	if bytes <= 0 {
+		return
+	}
+
+	victims := c.quota.victims(bytes)
+
+	if len(victims) == 0 {
+		return
+	}
+
+	start := time.Now()
+	evicted := 0
+	var evictedBytes int64 = 0
+
+	c.logInfo("Evicting " + strconv.Itoa(len(victims)) + " tiles to free " + strconv.FormatInt(bytes, 10) + " Bytes...")
+
+	for _, victim := range victims {
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+
+		err := c.Store.Delete(victim.key)
+
+		if err != nil {
+			c.logWarn("Could not evict [" + victim.key.String() + "], reason: " + err.Error())
+			continue
+		}
+
+		c.quota.remove(victim.key.String())
+		c.logDebug("Evicted tile [" + victim.key.String() + "], last accessed at " + victim.lastAccess.String())
+
+		evicted++
+		evictedBytes += victim.size
+	}
+
+	c.addStats(func(stats *CacheStats) {
+		stats.EvictedTiles += evicted
+		stats.BytesEvicted += evictedBytes
+	})
+
+	duration := time.Since(start)
+	c.logInfo("Evicted " + strconv.Itoa(evicted) + " tiles with " + strconv.FormatInt(evictedBytes, 10) + " Bytes (took " + duration.String() + ")")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -75,8 +76,15 @@ func main() {
 	sharedMemoryCache := maptilecache.NewSharedMemoryCache(sharedMemoryCacheConfig)
 	// var sharedMemoryCache *maptilecache.SharedMemoryCache = nil
 
+	server := maptilecache.NewServer(maptilecache.ServerConfig{
+		Port:        "9001",
+		DebugLogger: maptilecache.PrintlnDebugLogger,
+		InfoLogger:  maptilecache.PrintlnInfoLogger,
+		WarnLogger:  maptilecache.PrintlnWarnLogger,
+		ErrorLogger: maptilecache.PrintlnErrorLogger,
+	})
+
 	osmCacheConfig := maptilecache.CacheConfig{
-		Port:              "9002",
 		Route:             []string{"maptilecache", "osm"},
 		UrlScheme:         "http://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png",
 		TimeToLive:        ttl,
@@ -88,15 +96,15 @@ func main() {
 		ErrorLogger:       maptilecache.PrintlnErrorLogger,
 		StatsLogDelay:     statsLogDelay,
 	}
-	osmCache, err := maptilecache.New(osmCacheConfig)
+	osmCache, err := maptilecache.NewHandler(osmCacheConfig)
 
 	if err == nil {
+		server.Register(osmCache)
 		osmCache.ValidateCache()
 		osmCache.PreloadMemoryMap()
 	}
 
 	otmCacheConfig := maptilecache.CacheConfig{
-		Port:              "9003",
 		Route:             []string{"maptilecache", "otm"},
 		UrlScheme:         "https://{s}.tile.opentopomap.org/{z}/{x}/{y}.png",
 		TimeToLive:        ttl,
@@ -108,15 +116,15 @@ func main() {
 		ErrorLogger:       maptilecache.PrintlnErrorLogger,
 		StatsLogDelay:     statsLogDelay,
 	}
-	otmcache, err := maptilecache.New(otmCacheConfig)
+	otmcache, err := maptilecache.NewHandler(otmCacheConfig)
 
 	if err == nil {
+		server.Register(otmcache)
 		otmcache.ValidateCache()
 		otmcache.PreloadMemoryMap()
 	}
 
 	oaipAirportsCacheConfig := maptilecache.CacheConfig{
-		Port:              "9004",
 		Route:             []string{"maptilecache", "oaip-airports"},
 		UrlScheme:         "https://api.tiles.openaip.net/api/data/airports/{z}/{x}/{y}.png?apiKey={apiKey}",
 		TimeToLive:        ttl,
@@ -129,10 +137,13 @@ func main() {
 		ErrorLogger:       maptilecache.PrintlnErrorLogger,
 		StatsLogDelay:     statsLogDelay,
 	}
-	maptilecache.New(oaipAirportsCacheConfig)
+	oaipAirportsCache, err := maptilecache.NewHandler(oaipAirportsCacheConfig)
+
+	if err == nil {
+		server.Register(oaipAirportsCache)
+	}
 
 	oaipAirspacesCacheConfig := maptilecache.CacheConfig{
-		Port:              "9005",
 		Route:             []string{"maptilecache", "oaip-airspaces"},
 		UrlScheme:         "https://api.tiles.openaip.net/api/data/airspaces/{z}/{x}/{y}.png?apiKey={apiKey}",
 		TimeToLive:        ttl,
@@ -145,10 +156,13 @@ func main() {
 		ErrorLogger:       maptilecache.PrintlnErrorLogger,
 		StatsLogDelay:     statsLogDelay,
 	}
-	maptilecache.New(oaipAirspacesCacheConfig)
+	oaipAirspacesCache, err := maptilecache.NewHandler(oaipAirspacesCacheConfig)
+
+	if err == nil {
+		server.Register(oaipAirspacesCache)
+	}
 
 	oaipNavaidsCacheConfig := maptilecache.CacheConfig{
-		Port:              "9006",
 		Route:             []string{"maptilecache", "oaip-navaids"},
 		UrlScheme:         "https://api.tiles.openaip.net/api/data/navaids/{z}/{x}/{y}.png?apiKey={apiKey}",
 		TimeToLive:        ttl,
@@ -161,7 +175,18 @@ func main() {
 		ErrorLogger:       maptilecache.PrintlnErrorLogger,
 		StatsLogDelay:     statsLogDelay,
 	}
-	maptilecache.New(oaipNavaidsCacheConfig)
+	oaipNavaidsCache, err := maptilecache.NewHandler(oaipNavaidsCacheConfig)
+
+	if err == nil {
+		server.Register(oaipNavaidsCache)
+	}
+
+	err = server.Start()
+
+	if err != nil {
+		fmt.Println("Could not start server, reason: " + err.Error())
+		return
+	}
 
 	time.Sleep(1 * time.Second)
 	//testOne()
@@ -170,4 +195,17 @@ func main() {
 
 	fmt.Println("Press Enter Key to quit")
 	fmt.Scanln()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	server.Shutdown(ctx)
+
+	for _, cache := range []*maptilecache.Cache{osmCache, otmcache, oaipAirportsCache, oaipAirspacesCache, oaipNavaidsCache} {
+		if cache != nil {
+			cache.Close(ctx)
+		}
+	}
+
+	sharedMemoryCache.Close(ctx)
 }
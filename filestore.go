@@ -0,0 +1,634 @@
+package maptilecache
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/djherbis/times"
+)
+
+// FilePath describes where a tile is stored by a FileStore. Key is the tile's
+// path without extension, the extension depends on the tile's format, see
+// TilePath.
+type FilePath struct {
+	Path     string
+	Key      string
+	MetaPath string
+}
+
+func (fp FilePath) TilePath(format TileFormat) string {
+	return fp.Key + format.Extension()
+}
+
+const DEFAULT_FILE_MODE os.FileMode = 0644
+const DEFAULT_DIR_MODE os.FileMode = os.ModePerm
+
+// suffix of files that are being written, they are renamed once complete
+const TILE_TEMP_SUFFIX = ".tmp"
+
+// temp files older than this are left over from a crash, writing a tile never
+// takes that long
+const fileStoreTempMaxAge = time.Minute
+
+var errTempFileRemovalStopped = errors.New("temp file removal stopped")
+
+// FileStore is the default TileStore. Tiles are stored in the directory
+// {Root}/{route}/{params}/{z}/{y}/ as {x}.{ext} with their metadata in
+// {x}.meta.json. Files are written to a temp file first and renamed once
+// complete, so a crash never leaves a truncated tile behind.
+type FileStore struct {
+	Root     string // absolute
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	Sync     bool
+}
+
+type FileStoreConfig struct {
+	Root     string      // defaults to the working directory, relative paths are resolved on creation
+	FileMode os.FileMode // defaults to DEFAULT_FILE_MODE
+	DirMode  os.FileMode // defaults to DEFAULT_DIR_MODE
+	Sync     bool        // fsync files and their directory after writing, slower but survives power loss
+}
+
+func NewFileStore(config FileStoreConfig) *FileStore {
+	root := config.Root
+
+	if strings.TrimSpace(root) == "" {
+		root = "."
+	}
+
+	if absRoot, err := filepath.Abs(root); err == nil {
+		root = absRoot
+	}
+
+	fileMode := config.FileMode
+
+	if fileMode == 0 {
+		fileMode = DEFAULT_FILE_MODE
+	}
+
+	dirMode := config.DirMode
+
+	if dirMode == 0 {
+		dirMode = DEFAULT_DIR_MODE
+	}
+
+	return &FileStore{
+		Root:     filepath.Clean(root),
+		FileMode: fileMode,
+		DirMode:  dirMode,
+		Sync:     config.Sync,
+	}
+}
+
+func (s *FileStore) routeDir(route []string) (string, error) {
+	dir := filepath.Join(append([]string{s.Root}, route...)...)
+
+	if len(route) == 0 || !isPathBelow(s.Root, dir) {
+		return "", errors.New("illegal route: [" + strings.Join(route, "/") + "]")
+	}
+
+	return dir, nil
+}
+
+// filePath returns an error if the key would resolve to a path outside of its
+// route's directory, e.g. because a segment is "..".
+func (s *FileStore) filePath(key TileKey) (FilePath, error) {
+	routeDir, err := s.routeDir(key.Route)
+
+	if err != nil {
+		return FilePath{}, err
+	}
+
+	pathArray := append([]string{routeDir}, key.Params...)
+	pathArray = append(pathArray, key.Z, key.Y)
+
+	path := filepath.Join(pathArray...)
+	tileKey := filepath.Join(path, key.X)
+
+	if !isPathBelow(routeDir, path) || !isPathBelow(path, tileKey) {
+		return FilePath{}, errors.New("illegal tile key: [" + key.String() + "]")
+	}
+
+	return FilePath{
+		Path:     path,
+		Key:      tileKey,
+		MetaPath: tileKey + TILE_META_SUFFIX,
+	}, nil
+}
+
+// findTile returns the path of the stored tile in any format. If no tile
+// exists, os.ErrNotExist is returned.
+func (s *FileStore) findTile(fp FilePath) (string, TileFormat, os.FileInfo, error) {
+	for _, format := range allTileFormats {
+		tilePath := fp.TilePath(format)
+
+		if info, err := os.Stat(tilePath); err == nil {
+			return tilePath, format, info, nil
+		}
+	}
+
+	return "", "", nil, os.ErrNotExist
+}
+
+func (s *FileStore) Get(key TileKey) (*StoredTile, error) {
+	fp, err := s.filePath(key)
+
+	if err != nil {
+		return nil, err
+	}
+	tilePath, format, _, err := s.findTile(fp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(tilePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := times.Stat(tilePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	meta, metaErr := readTileMeta(fp.MetaPath)
+
+	if metaErr != nil {
+		meta = nil
+	}
+
+	return &StoredTile{
+		Data:    data,
+		Format:  format,
+		Meta:    meta,
+		ModTime: t.ModTime(),
+	}, nil
+}
+
+func (s *FileStore) Put(key TileKey, tile *StoredTile) error {
+	fp, err := s.filePath(key)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(fp.Path, s.DirMode)
+
+	if err != nil {
+		return err
+	}
+
+	if len(tile.Data) > 0 {
+		err = s.writeFile(fp.TilePath(tile.Format), tile.Data)
+
+		if err != nil {
+			return err
+		}
+
+		if !tile.ModTime.IsZero() {
+			os.Chtimes(fp.TilePath(tile.Format), tile.ModTime, tile.ModTime)
+		}
+	}
+
+	// the origin may have changed the tile's format
+	for _, format := range allTileFormats {
+		if format != tile.Format || len(tile.Data) == 0 {
+			os.Remove(fp.TilePath(format))
+		}
+	}
+
+	if tile.Meta == nil {
+		os.Remove(fp.MetaPath)
+		return nil
+	}
+
+	data, err := json.Marshal(tile.Meta)
+
+	if err != nil {
+		return err
+	}
+
+	return s.writeFile(fp.MetaPath, data)
+}
+
+// Touch replaces the metadata of a stored tile and sets its modtime, the tile
+// itself is not rewritten.
+func (s *FileStore) Touch(info TileInfo, modTime time.Time) error {
+	fp, err := s.filePath(info.Key)
+
+	if err != nil {
+		return err
+	}
+
+	tilePath := fp.TilePath(info.Format)
+	err = os.Chtimes(tilePath, modTime, modTime)
+
+	if err != nil {
+		return err
+	}
+
+	if info.Meta == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(info.Meta)
+
+	if err != nil {
+		return err
+	}
+
+	return s.writeFile(fp.MetaPath, data)
+}
+
+// writeFile writes data to a temp file next to path and renames it to path,
+// so readers either see the old or the new file, but never a partial one.
+func (s *FileStore) writeFile(path string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*"+TILE_TEMP_SUFFIX)
+
+	if err != nil {
+		return err
+	}
+
+	tempPath := file.Name()
+
+	_, err = file.Write(data)
+
+	if err == nil {
+		err = file.Chmod(s.FileMode)
+	}
+
+	if err == nil && s.Sync {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if s.Sync {
+		syncDir(filepath.Dir(path))
+	}
+
+	return nil
+}
+
+// syncDir persists the directory entry of a renamed file. Not all platforms
+// support syncing directories, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+
+	if err != nil {
+		return
+	}
+
+	d.Sync()
+	d.Close()
+}
+
+// RemoveTempFiles deletes temp files below the route that are left over from
+// writes interrupted by a crash. It returns the number of removed files. The
+// walk is aborted once stop is closed.
+func (s *FileStore) RemoveTempFiles(route []string, stop <-chan struct{}) (int, error) {
+	root, err := s.routeDir(route)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(root); err != nil {
+		return 0, nil
+	}
+
+	removed := 0
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		select {
+		case <-stop:
+			return errTempFileRemovalStopped
+		default:
+		}
+
+		if err != nil || info.IsDir() || !strings.HasSuffix(info.Name(), TILE_TEMP_SUFFIX) {
+			return nil
+		}
+
+		// younger files may belong to a write that is still in progress
+		if time.Since(info.ModTime()) < fileStoreTempMaxAge {
+			return nil
+		}
+
+		if os.Remove(path) == nil {
+			removed++
+		}
+
+		return nil
+	})
+
+	return removed, err
+}
+
+// Delete removes the tile and its metadata. Directories left empty are removed
+// as well.
+func (s *FileStore) Delete(key TileKey) error {
+	fp, err := s.filePath(key)
+
+	if err != nil {
+		return err
+	}
+
+	for _, path := range append(tilePaths(fp), fp.MetaPath) {
+		removeErr := os.Remove(path)
+
+		if removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = removeErr
+		}
+	}
+
+	s.removeEmptyDirs(fp.Path)
+
+	return err
+}
+
+func tilePaths(fp FilePath) []string {
+	paths := []string{}
+	for _, format := range allTileFormats {
+		paths = append(paths, fp.TilePath(format))
+	}
+
+	return paths
+}
+
+func (s *FileStore) removeEmptyDirs(dir string) {
+	for {
+		rel, err := filepath.Rel(s.Root, dir)
+
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return
+		}
+
+		files, err := ioutil.ReadDir(dir)
+
+		if err != nil || len(files) > 0 || os.Remove(dir) != nil {
+			return
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (s *FileStore) Stat(key TileKey) (*TileInfo, error) {
+	fp, err := s.filePath(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	meta, metaErr := readTileMeta(fp.MetaPath)
+
+	if metaErr != nil {
+		meta = nil
+	}
+
+	if _, format, info, err := s.findTile(fp); err == nil {
+		return &TileInfo{
+			Key:     key,
+			Format:  format,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Meta:    meta,
+		}, nil
+	}
+
+	metaInfo, err := os.Stat(fp.MetaPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &TileInfo{
+		Key:     key,
+		ModTime: metaInfo.ModTime(),
+		Meta:    meta,
+	}, nil
+}
+
+func (s *FileStore) Iterate(route []string, fn func(info TileInfo) error) error {
+	root, err := s.routeDir(route)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(root); err != nil {
+		return nil
+	}
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			// e.g. a directory that has been removed while iterating
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+
+		if err != nil {
+			return nil
+		}
+
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+
+		if rel == "." || len(segments) < 2 {
+			return nil
+		}
+
+		files, err := ioutil.ReadDir(path)
+
+		if err != nil {
+			return nil
+		}
+
+		tiles := make(map[string]*TileInfo)
+		names := []string{}
+
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+
+			name := file.Name()
+			if !isMetaFile(name) && tileFileFormat(name) == "" {
+				continue
+			}
+
+			x := tileFileKey(name)
+
+			tile, exists := tiles[x]
+			if !exists {
+				tile = &TileInfo{
+					Key: TileKey{
+						Route:  route,
+						Params: segments[:len(segments)-2],
+						Z:      segments[len(segments)-2],
+						Y:      segments[len(segments)-1],
+						X:      x,
+					},
+				}
+				tiles[x] = tile
+				names = append(names, x)
+			}
+
+			if isMetaFile(name) {
+				meta, metaErr := readTileMeta(filepath.Join(path, name))
+				if metaErr == nil {
+					tile.Meta = meta
+				}
+
+				if tile.Format == "" {
+					tile.ModTime = file.ModTime()
+				}
+			} else {
+				tile.Format = tileFileFormat(name)
+				tile.Size = file.Size()
+				tile.ModTime = file.ModTime()
+			}
+		}
+
+		sort.Strings(names)
+
+		for _, x := range names {
+			err = fn(*tiles[x])
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// removableDir returns the directory of the route and params if it may be
+// removed, i.e. it is located below Root and is not a dangerous path itself.
+func (s *FileStore) removableDir(route []string, params []string) (string, error) {
+	routeDir, err := s.routeDir(route)
+
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(append([]string{routeDir}, params...)...)
+
+	if isPathDangerous(dir) || (len(params) > 0 && !isPathBelow(routeDir, dir)) {
+		return "", errors.New("illegal cacheRoot: [" + dir + "]")
+	}
+
+	return dir, nil
+}
+
+// Clear removes all tiles of the route.
+func (s *FileStore) Clear(route []string) error {
+	cacheRoot, err := s.removableDir(route, nil)
+
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(cacheRoot)
+}
+
+// DeletePrefix removes all tiles of the route whose params start with params.
+func (s *FileStore) DeletePrefix(route []string, params []string) error {
+	if len(params) == 0 {
+		return s.Clear(route)
+	}
+
+	dir, err := s.removableDir(route, params)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(dir)
+
+	if err == nil {
+		s.removeEmptyDirs(filepath.Dir(dir))
+	}
+
+	return err
+}
+
+func tileFileKey(name string) string {
+	if isMetaFile(name) {
+		return strings.TrimSuffix(name, TILE_META_SUFFIX)
+	}
+
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+func tileFileFormat(name string) TileFormat {
+	ext := filepath.Ext(name)
+
+	for _, format := range allTileFormats {
+		if format.Extension() == ext {
+			return format
+		}
+	}
+
+	return ""
+}
+
+// isPathDangerous reports whether path must never be removed: an empty path, a
+// filesystem or volume root like "/" or "C:\", or the user's home directory.
+// Relative paths are resolved against the working directory first.
+func isPathDangerous(path string) bool {
+	if strings.TrimSpace(path) == "" {
+		return true
+	}
+
+	absPath, err := filepath.Abs(path)
+
+	if err != nil {
+		return true
+	}
+
+	if filepath.Dir(absPath) == absPath {
+		return true
+	}
+
+	home, err := os.UserHomeDir()
+
+	return err == nil && absPath == filepath.Clean(home)
+}
+
+// isPathBelow reports whether path is located below root, root itself does not
+// count.
+func isPathBelow(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+
+	if err != nil {
+		return false
+	}
+
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
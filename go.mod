@@ -7,5 +7,6 @@ require (
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	github.com/shirou/gopsutil/v3 v3.22.6
 	github.com/yusufpapurcu/wmi v1.2.2 // indirect
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/sys v0.0.0-20220712014510-0a85c31ab51e // indirect
 )
@@ -76,7 +76,13 @@ func (c *Cache) LogSystemStats() {
 	s, _ := mem.SwapMemory()
 	h, _ := host.Info()
 	cpu, _ := cpu.Info()
-	d, _ := disk.Usage("/")
+	usagePath := c.quota.usagePath
+
+	if usagePath == "" {
+		usagePath = "/"
+	}
+
+	d, _ := disk.Usage(usagePath)
 
 	out := "SYSTEM INFO\n" +
 		"\t" + fmt.Sprintf("Virtual Memory: %s\n", v) +
@@ -88,19 +94,47 @@ func (c *Cache) LogSystemStats() {
 	c.logDebug(out)
 }
 
+// addStats updates Stats under statsMutex.
+func (c *Cache) addStats(update func(stats *CacheStats)) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+
+	update(&c.Stats)
+}
+
 func (c *Cache) LogStats() {
+	c.statsMutex.Lock()
+	stats := c.Stats
+	c.statsMutex.Unlock()
+
 	cachePercentage := "0"
 	originPercentage := "0"
 
-	if c.Stats.BytesServedFromCache+c.Stats.BytesServedFromOrigin > 0 {
-		cachePercentage = fmt.Sprintf("%.2f", 100*float64(c.Stats.BytesServedFromCache)/float64(c.Stats.BytesServedFromCache+c.Stats.BytesServedFromOrigin))
-		originPercentage = fmt.Sprintf("%.2f", 100*float64(c.Stats.BytesServedFromOrigin)/float64(c.Stats.BytesServedFromCache+c.Stats.BytesServedFromOrigin))
+	if stats.BytesServedFromCache+stats.BytesServedFromOrigin > 0 {
+		cachePercentage = fmt.Sprintf("%.2f", 100*float64(stats.BytesServedFromCache)/float64(stats.BytesServedFromCache+stats.BytesServedFromOrigin))
+		originPercentage = fmt.Sprintf("%.2f", 100*float64(stats.BytesServedFromOrigin)/float64(stats.BytesServedFromCache+stats.BytesServedFromOrigin))
+	}
+
+	averageWriteLatency := time.Duration(0)
+
+	if writes := stats.WritesCompleted + stats.WritesFailed; writes > 0 {
+		averageWriteLatency = stats.WriteLatency / time.Duration(writes)
 	}
 
-	c.logInfo("Served from Origin: " + strconv.Itoa(c.Stats.BytesServedFromOrigin) + " Bytes (" + originPercentage + "%), " +
-		"Served from Cache: " + strconv.Itoa(c.Stats.BytesServedFromCache) + " Bytes (" + cachePercentage + "%, " +
-		"(HDD: " + strconv.Itoa(c.Stats.BytesServedFromHDD) + " Bytes, " +
-		"RAM: " + strconv.Itoa(c.Stats.BytesServedFromMemory) + " Bytes))")
+	c.logInfo("Served from Origin: " + strconv.Itoa(stats.BytesServedFromOrigin) + " Bytes (" + originPercentage + "%), " +
+		"Served from Cache: " + strconv.Itoa(stats.BytesServedFromCache) + " Bytes (" + cachePercentage + "%, " +
+		"(HDD: " + strconv.Itoa(stats.BytesServedFromHDD) + " Bytes, " +
+		"RAM: " + strconv.Itoa(stats.BytesServedFromMemory) + " Bytes, " +
+		"Archive: " + strconv.Itoa(stats.BytesServedFromArchive) + " Bytes)), " +
+		"Served Stale: " + strconv.Itoa(stats.BytesServedStale) + " Bytes, " +
+		"Coalesced Requests: " + strconv.Itoa(stats.CoalescedRequests) + ", " +
+		"Background Refreshes: " + strconv.Itoa(stats.BackgroundRefreshes) + ", " +
+		"Negative Hits: " + strconv.Itoa(stats.NegativeHits) + ", " +
+		"Writes: " + strconv.Itoa(stats.WritesCompleted) + " (Failed: " + strconv.Itoa(stats.WritesFailed) + ", Dropped: " + strconv.Itoa(stats.WritesDropped) + ", " +
+		"Avg Latency: " + averageWriteLatency.String() + "), " +
+		"Write Queue: " + strconv.Itoa(c.WriteQueueLength()) + "/" + strconv.Itoa(c.writes.capacity()) + " (Max: " + strconv.Itoa(stats.MaxWriteQueueLength) + "), " +
+		"Evicted: " + strconv.Itoa(stats.EvictedTiles) + " Tiles (" + strconv.FormatInt(stats.BytesEvicted, 10) + " Bytes), " +
+		"Circuit Breaker: " + c.breaker.String())
 }
 
 func (c *Cache) InitLogStatsRunner() {
@@ -110,10 +144,18 @@ func (c *Cache) InitLogStatsRunner() {
 	}
 
 	go func() {
+		ticker := time.NewTicker(c.Logger.StatsLogDelay)
+		defer ticker.Stop()
+
 		for {
 			c.LogSystemStats()
 			c.LogStats()
-			time.Sleep(c.Logger.StatsLogDelay)
+
+			select {
+			case <-ticker.C:
+			case <-c.quit:
+				return
+			}
 		}
 	}()
 }
@@ -1,50 +1,97 @@
 package maptilecache
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/djherbis/times"
 )
 
 const DEFAULT_HTTP_CLIENT_TIMEOUT = 6 * time.Second
+const MAX_STALE_AGE_UNLIMITED = -1
 
-type FilePath struct {
-	Path     string
-	FullPath string
-}
+var errTileOutdated = errors.New("Tile is too old!")
 
 type CacheStats struct {
-	BytesServedFromCache  int
-	BytesServedFromHDD    int
-	BytesServedFromMemory int
-	BytesServedFromOrigin int
+	BytesServedFromCache   int
+	BytesServedFromHDD     int
+	BytesServedFromMemory  int
+	BytesServedFromArchive int
+	BytesServedFromOrigin  int
+	BytesServedStale       int
+	CoalescedRequests      int
+	BackgroundRefreshes    int
+	RevalidatedTiles       int
+	NegativeHits           int
+	WritesCompleted        int
+	WritesFailed           int
+	WritesDropped          int
+	MaxWriteQueueLength    int
+	WriteLatency           time.Duration // sum over all writes, from queueing the tile until it is written
+	EvictedTiles           int
+	BytesEvicted           int64
 }
 
 type Cache struct {
-	Host            string
-	Port            string
-	Route           []string
-	RouteString     string
-	UrlScheme       string
-	StructureParams []string
-	TimeToLive      time.Duration
-	ForwardHeaders  bool
-	SharedMemCache  *SharedMemoryCache
-	Client          *http.Client
-	ApiKey          string
-	Stats           CacheStats
-	Logger          LoggerConfig
+	Host                     string
+	Port                     string
+	Route                    []string
+	RouteString              string
+	UrlScheme                string
+	StructureParams          []string
+	TileFormats              []TileFormat
+	Validator                TileValidator
+	Store                    TileStore
+	Archive                  *PMTilesArchive
+	TimeToLive               time.Duration
+	SoftTimeToLive           time.Duration
+	HardTimeToLive           time.Duration
+	MaxStaleAge              time.Duration
+	NegativeTimeToLive       time.Duration
+	NegativeEmptyTile        bool
+	TileSize                 int
+	ErrorTile                ErrorTileMode
+	ErrorTileImage           []byte
+	ForwardHeaders           bool
+	SharedMemCache           *SharedMemoryCache
+	Client                   *http.Client
+	ApiKey                   string
+	OriginMaxRetries         int
+	OriginRetryBaseDelay     time.Duration
+	OriginRetryMaxDelay      time.Duration
+	ValidationInterval       time.Duration
+	ValidationBatchSize      int
+	ValidationTilesPerSecond float64
+	Stats                    CacheStats
+	Logger                   LoggerConfig
+	server                   *Server
+	closeMutex               *sync.RWMutex
+	closed                   bool
+	closeOnce                *sync.Once
+	quit                     chan struct{}
+	backgroundCtx            context.Context
+	cancelBackground         context.CancelFunc
+	fetchCtx                 context.Context
+	cancelFetches            context.CancelFunc
+	inFlight                 *sync.WaitGroup
+	writes                   *writeQueue
+	statsMutex               *sync.Mutex
+	quota                    *diskQuota
+	validation               *validationState
+	flights                  *flightGroup
+	originLimiter            *originLimiter
+	breaker                  *circuitBreaker
+	negatives                *negativeCache
+	emptyTileOnce            *sync.Once
+	emptyTileData            []byte
 }
 
 type CacheConfig struct {
@@ -53,7 +100,13 @@ type CacheConfig struct {
 	Route             []string
 	UrlScheme         string
 	StructureParams   []string
+	TileFormats       []TileFormat    // accepted formats, defaults to DEFAULT_TILE_FORMATS
+	Validator         TileValidator   // validates tiles from the origin, defaults to MagicByteValidator
+	Store             TileStore       // persists tiles, defaults to a FileStore in CacheDir
+	Archive           *PMTilesArchive // read before the origin, leave UrlScheme empty to serve from the archive only
 	TimeToLive        time.Duration
+	SoftTimeToLive    time.Duration // older tiles are served, but refreshed in the background, 0 disables
+	HardTimeToLive    time.Duration // older tiles are refreshed before serving, defaults to TimeToLive
 	ForwardHeaders    bool
 	SharedMemoryCache *SharedMemoryCache
 	HttpClientTimeout time.Duration
@@ -63,11 +116,157 @@ type CacheConfig struct {
 	WarnLogger        func(string)
 	ErrorLogger       func(string)
 	StatsLogDelay     time.Duration
+
+	// the default FileStore's root directory, permissions and durability, must
+	// not be set if Store is set. CacheDir defaults to the working directory,
+	// FileMode and DirMode to DEFAULT_FILE_MODE and DEFAULT_DIR_MODE.
+	// SyncWrites fsyncs every tile after writing it.
+	CacheDir   string
+	FileMode   os.FileMode
+	DirMode    os.FileMode
+	SyncWrites bool
+
+	// stale-if-error: if refreshing an expired tile fails, it is still served
+	// as long as it expired no longer than MaxStaleAge ago. 0 disables
+	// stale-if-error, MAX_STALE_AGE_UNLIMITED serves tiles of any age.
+	MaxStaleAge time.Duration
+
+	// negative caching: origin responses with 404 or 204 are remembered for
+	// NegativeTimeToLive (0 disables negative caching). Such tiles are answered
+	// with a 404, or with a transparent TileSize x TileSize PNG (default 256)
+	// if NegativeEmptyTile is set.
+	NegativeTimeToLive time.Duration
+	NegativeEmptyTile  bool
+	TileSize           int
+
+	// answer to requests that fail (e.g. the origin is down), defaults to
+	// ERROR_TILE_NONE (404). ErrorTileImage is served for ERROR_TILE_IMAGE.
+	ErrorTile      ErrorTileMode
+	ErrorTileImage []byte
+
+	// limits for requests to the origin, 0 means unlimited. OriginBurst is the
+	// token bucket size for OriginRequestsPerSecond and defaults to 1.
+	MaxOriginConnections    int
+	OriginRequestsPerSecond float64
+	OriginBurst             int
+
+	// tiles are persisted by WriteWorkers goroutines (defaults to
+	// DEFAULT_WRITE_WORKERS) from a queue of WriteQueueSize tiles (defaults to
+	// DEFAULT_WRITE_QUEUE_SIZE). If the queue is full, WriteQueuePolicy decides
+	// whether requests wait for a free slot or the tile is not persisted.
+	WriteWorkers     int
+	WriteQueueSize   int
+	WriteQueuePolicy WriteQueuePolicy
+
+	// disk quota: once the cache's tiles exceed MaxDiskBytes, or the free space
+	// on the disk of CacheDir drops below MinFreeDiskBytes, the least recently
+	// accessed tiles are removed in the background. Limits are checked every
+	// DiskQuotaCheckInterval (defaults to DEFAULT_DISK_QUOTA_CHECK_INTERVAL)
+	// and after writes, 0 disables either limit. MinFreeDiskBytes requires
+	// the default FileStore.
+	MaxDiskBytes           int64
+	MinFreeDiskBytes       uint64
+	DiskQuotaCheckInterval time.Duration
+
+	// background validation: every ValidationInterval (0 disables),
+	// ValidateCache inspects up to ValidationBatchSize tiles (0 means all) at
+	// ValidationTilesPerSecond (0 means unlimited). Both limits apply to
+	// manual calls as well, each run continues where the previous one stopped.
+	ValidationInterval       time.Duration
+	ValidationBatchSize      int
+	ValidationTilesPerSecond float64
+
+	// retries for transport errors and 429, 502, 503 and 504 responses,
+	// OriginMaxRetries == 0 disables retries
+	OriginMaxRetries     int
+	OriginRetryBaseDelay time.Duration
+	OriginRetryMaxDelay  time.Duration
+
+	// the circuit breaker opens after BreakerFailureThreshold consecutive
+	// origin failures, BreakerFailureThreshold == 0 disables it
+	BreakerFailureThreshold int
+	BreakerOpenDuration     time.Duration
+	BreakerHalfOpenProbes   int
 }
 
+// New creates a cache and starts a dedicated listener on Host:Port that serves
+// it. Use NewHandler instead to mount the cache on an existing http server or
+// to register several caches with one Server.
 func New(config CacheConfig) (*Cache, error) {
 	start := time.Now()
 
+	c, err := newCache(config)
+
+	if err != nil {
+		return c, err
+	}
+
+	if strings.TrimSpace(c.Host) == "" || strings.TrimSpace(c.Port) == "" {
+		return c, errors.New("could not initialize cache, reason: host and/or port not defined")
+	}
+
+	server := NewServer(ServerConfig{
+		Host:        c.Host,
+		Port:        c.Port,
+		DebugLogger: config.DebugLogger,
+		InfoLogger:  config.InfoLogger,
+		WarnLogger:  config.WarnLogger,
+		ErrorLogger: config.ErrorLogger,
+	})
+
+	err = server.Register(c)
+
+	if err != nil {
+		return c, err
+	}
+
+	err = server.Start()
+
+	if err != nil {
+		return c, err
+	}
+
+	c.server = server
+
+	c.writes.start(config.WriteWorkers, c.writeDone)
+	c.InitLogStatsRunner()
+	c.initEvictor(config.DiskQuotaCheckInterval)
+	c.initValidationRunner()
+	c.initNegativePruner()
+	c.initTempFileRemover()
+
+	duration := time.Since(start)
+	c.logInfo("New Cache initialized on " + c.Host + ":" + c.Port + "/" + c.RouteString + "/ (took " + duration.String() + ")")
+
+	return c, nil
+}
+
+// NewHandler creates a cache without starting a listener. The returned cache
+// implements http.Handler and must be mounted at "/" + RouteString + "/", e.g.
+// mux.Handle("/maptilecache/osm/", cache). Host and Port are ignored.
+func NewHandler(config CacheConfig) (*Cache, error) {
+	start := time.Now()
+
+	c, err := newCache(config)
+
+	if err != nil {
+		return c, err
+	}
+
+	c.writes.start(config.WriteWorkers, c.writeDone)
+	c.InitLogStatsRunner()
+	c.initEvictor(config.DiskQuotaCheckInterval)
+	c.initValidationRunner()
+	c.initNegativePruner()
+	c.initTempFileRemover()
+
+	duration := time.Since(start)
+	c.logInfo("New Cache handler initialized for /" + c.RouteString + "/ (took " + duration.String() + ")")
+
+	return c, nil
+}
+
+func newCache(config CacheConfig) (*Cache, error) {
 	routeString := routeString(config.Route)
 
 	timeout := config.HttpClientTimeout
@@ -76,18 +275,83 @@ func New(config CacheConfig) (*Cache, error) {
 		timeout = DEFAULT_HTTP_CLIENT_TIMEOUT
 	}
 
+	tileFormats := config.TileFormats
+
+	if len(tileFormats) == 0 {
+		tileFormats = DEFAULT_TILE_FORMATS
+	}
+
+	tileSize := config.TileSize
+
+	if tileSize <= 0 {
+		tileSize = DEFAULT_TILE_SIZE
+	}
+
+	validator := config.Validator
+
+	if validator == nil {
+		validator = MagicByteValidator{}
+	}
+
+	store := config.Store
+
+	if store == nil {
+		store = NewFileStore(FileStoreConfig{
+			Root:     config.CacheDir,
+			FileMode: config.FileMode,
+			DirMode:  config.DirMode,
+			Sync:     config.SyncWrites,
+		})
+	}
+
+	hardTimeToLive := config.HardTimeToLive
+
+	if hardTimeToLive <= 0 {
+		hardTimeToLive = config.TimeToLive
+	}
+
+	retryBaseDelay := config.OriginRetryBaseDelay
+
+	if retryBaseDelay <= 0 {
+		retryBaseDelay = DEFAULT_ORIGIN_RETRY_BASE_DELAY
+	}
+
+	retryMaxDelay := config.OriginRetryMaxDelay
+
+	if retryMaxDelay <= 0 {
+		retryMaxDelay = DEFAULT_ORIGIN_RETRY_MAX_DELAY
+	}
+
 	c := Cache{
-		Host:            config.Host,
-		Port:            config.Port,
-		Route:           config.Route,
-		RouteString:     routeString,
-		UrlScheme:       config.UrlScheme,
-		StructureParams: config.StructureParams,
-		TimeToLive:      config.TimeToLive,
-		ForwardHeaders:  config.ForwardHeaders,
-		SharedMemCache:  config.SharedMemoryCache,
-		Client:          &http.Client{Timeout: timeout},
-		ApiKey:          config.ApiKey,
+		Host:                     config.Host,
+		Port:                     config.Port,
+		Route:                    config.Route,
+		RouteString:              routeString,
+		UrlScheme:                config.UrlScheme,
+		StructureParams:          config.StructureParams,
+		TileFormats:              tileFormats,
+		Validator:                validator,
+		Store:                    store,
+		Archive:                  config.Archive,
+		TimeToLive:               config.TimeToLive,
+		SoftTimeToLive:           config.SoftTimeToLive,
+		HardTimeToLive:           hardTimeToLive,
+		MaxStaleAge:              config.MaxStaleAge,
+		NegativeTimeToLive:       config.NegativeTimeToLive,
+		NegativeEmptyTile:        config.NegativeEmptyTile,
+		TileSize:                 tileSize,
+		ErrorTile:                config.ErrorTile,
+		ErrorTileImage:           config.ErrorTileImage,
+		ForwardHeaders:           config.ForwardHeaders,
+		SharedMemCache:           config.SharedMemoryCache,
+		Client:                   &http.Client{Timeout: timeout},
+		ApiKey:                   config.ApiKey,
+		OriginMaxRetries:         config.OriginMaxRetries,
+		OriginRetryBaseDelay:     retryBaseDelay,
+		OriginRetryMaxDelay:      retryMaxDelay,
+		ValidationInterval:       config.ValidationInterval,
+		ValidationBatchSize:      config.ValidationBatchSize,
+		ValidationTilesPerSecond: config.ValidationTilesPerSecond,
 		Logger: LoggerConfig{
 			LogPrefix:     "Cache[" + routeString + "]",
 			LogDebugFunc:  config.DebugLogger,
@@ -96,49 +360,184 @@ func New(config CacheConfig) (*Cache, error) {
 			LogErrorFunc:  config.ErrorLogger,
 			StatsLogDelay: config.StatsLogDelay,
 		},
+		closeMutex:    &sync.RWMutex{},
+		closeOnce:     &sync.Once{},
+		quit:          make(chan struct{}),
+		inFlight:      &sync.WaitGroup{},
+		writes:        newWriteQueue(config.WriteQueueSize, config.WriteQueuePolicy),
+		statsMutex:    &sync.Mutex{},
+		validation:    newValidationState(),
+		flights:       newFlightGroup(),
+		negatives:     newNegativeCache(),
+		emptyTileOnce: &sync.Once{},
+		originLimiter: newOriginLimiter(config.MaxOriginConnections, config.OriginRequestsPerSecond, config.OriginBurst),
 	}
 
+	c.backgroundCtx, c.cancelBackground = context.WithCancel(context.Background())
+	c.fetchCtx, c.cancelFetches = context.WithCancel(context.Background())
+
+	c.breaker = newCircuitBreaker(config.BreakerFailureThreshold, config.BreakerOpenDuration, config.BreakerHalfOpenProbes, func(from BreakerState, to BreakerState) {
+		c.logWarn("Circuit breaker changed from " + from.String() + " to " + to.String() + ".")
+	})
+
 	c.logDebug("Timeout: " + timeout.String())
 
+	usagePath := ""
+
+	if fileStore, ok := c.Store.(*FileStore); ok {
+		c.logDebug("Cache dir: " + fileStore.Root)
+		usagePath = fileStore.Root
+	}
+
+	c.quota = newDiskQuota(config.MaxDiskBytes, config.MinFreeDiskBytes, usagePath)
+
 	if len(config.Route) < 1 {
 		return &c, errors.New("could not initialize cache, reason: route invalid, must have at least one entry")
 	}
 
-	if strings.TrimSpace(c.Host) == "" || strings.TrimSpace(c.Port) == "" {
-		return &c, errors.New("could not initialize cache, reason: host and/or port not defined")
+	if config.Store != nil && (config.CacheDir != "" || config.FileMode != 0 || config.DirMode != 0 || config.SyncWrites) {
+		return &c, errors.New("could not initialize cache, reason: CacheDir, FileMode, DirMode and SyncWrites only apply to the default FileStore, but a Store is set")
 	}
 
-	serverMux := http.NewServeMux()
-	serverMux.HandleFunc("/"+routeString+"/", c.serve)
-	host := c.Host + ":" + c.Port
-	go http.ListenAndServe(host, serverMux)
-
-	c.InitLogStatsRunner()
+	if c.ErrorTile == ERROR_TILE_IMAGE && len(c.ErrorTileImage) == 0 {
+		return &c, errors.New("could not initialize cache, reason: ErrorTile is ERROR_TILE_IMAGE, but ErrorTileImage is empty")
+	}
 
-	duration := time.Since(start)
-	c.logInfo("New Cache initialized on " + host + "/" + routeString + "/ (took " + duration.String() + ")")
+	if config.MinFreeDiskBytes > 0 && usagePath == "" {
+		return &c, errors.New("could not initialize cache, reason: MinFreeDiskBytes requires the default FileStore")
+	}
 
 	return &c, nil
+}
+
+// initTempFileRemover removes temp files left over from interrupted writes in
+// the background, if the store supports it.
+func (c *Cache) initTempFileRemover() {
+	remover, ok := c.Store.(tileStoreTempFileRemover)
+
+	if !ok {
+		return
+	}
+
+	c.inFlight.Add(1)
+
+	go func() {
+		defer c.inFlight.Done()
+
+		removed, err := remover.RemoveTempFiles(c.Route, c.quit)
 
+		if err == errTempFileRemovalStopped {
+			return
+		} else if err != nil {
+			c.logWarn("Could not remove leftover temp files, reason: " + err.Error())
+		} else if removed > 0 {
+			c.logInfo("Removed " + strconv.Itoa(removed) + " leftover temp files from interrupted writes.")
+		}
+	}()
+}
+
+// BreakerState returns the current state of the origin's circuit breaker.
+func (c *Cache) BreakerState() BreakerState {
+	return c.breaker.State()
 }
 
 func routeString(route []string) string {
 	return strings.Join(route, "/")
 }
 
+// Close stops the cache. If the cache was created with New, its listener is
+// shut down first. Close then waits for in-flight requests to finish and for
+// pending writes to be flushed to disk, and stops all background goroutines.
+// If ctx expires before that, ctx.Err() is returned and origin fetches that
+// are still running are cancelled.
+func (c *Cache) Close(ctx context.Context) error {
+	start := time.Now()
+	c.logInfo("Closing cache...")
+
+	c.closeMutex.Lock()
+	c.closed = true
+	c.closeMutex.Unlock()
+
+	// background goroutines stop right away, origin fetches are left running
+	// until the requests waiting for them are done
+	c.closeOnce.Do(func() {
+		close(c.quit)
+		c.cancelBackground()
+	})
+	defer c.cancelFetches()
+
+	if c.server != nil {
+		err := c.server.Shutdown(ctx)
+
+		if err != nil {
+			c.logWarn("Could not shut down server, reason: " + err.Error())
+			return err
+		}
+	}
+
+	err := waitWithContext(ctx, c.inFlight)
+
+	if err != nil {
+		c.logWarn("Could not drain in-flight requests, reason: " + err.Error())
+		return err
+	}
+
+	c.writes.close()
+	err = waitWithContext(ctx, c.writes.workers)
+
+	if err != nil {
+		c.logWarn("Could not flush pending writes, reason: " + err.Error())
+		return err
+	}
+
+	duration := time.Since(start)
+	c.logInfo("Cache closed (took " + duration.String() + ")")
+
+	return nil
+}
+
+func waitWithContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (c *Cache) WipeCache() error {
 	c.logInfo("Wiping cache...")
 
 	start := time.Now()
 
-	cacheRoot := filepath.Join(append([]string{"."}, c.Route...)...)
-	if isPathDangerous(cacheRoot) {
-		msg := "Cache could not be wiped, illegal cacheRoot: [" + cacheRoot + "]"
-		c.logError(msg)
-		return errors.New(msg)
+	var err error
+
+	if clearer, ok := c.Store.(tileStoreClearer); ok {
+		err = clearer.Clear(c.Route)
+	} else {
+		keys := []TileKey{}
+		err = c.Store.Iterate(c.Route, func(info TileInfo) error {
+			keys = append(keys, info.Key)
+			return nil
+		})
+
+		for _, key := range keys {
+			if err != nil {
+				break
+			}
+
+			err = c.Store.Delete(key)
+		}
 	}
 
-	err := os.RemoveAll(cacheRoot)
+	c.quota.reset()
 
 	if err != nil {
 		c.logWarn("Cache could not be wiped, reason: " + err.Error())
@@ -150,32 +549,104 @@ func (c *Cache) WipeCache() error {
 	return err
 }
 
-func (c *Cache) memoryMapLoad(requestIdPrefix string, requestParams *url.Values, x string, y string, z string) (*[]byte, error) {
+// PurgeParams removes all tiles that were requested with the given values of
+// the cache's StructureParams, e.g. all tiles of one map style. Values are
+// matched in the order of StructureParams, like the cache's folder structure.
+func (c *Cache) PurgeParams(requestParams *url.Values) error {
+	params := c.makeTileKey(requestParams, "", "", "").Params
+
+	if len(params) == 0 {
+		return errors.New("could not purge tiles, reason: no StructureParams given, use WipeCache to remove all tiles")
+	}
+
+	c.logInfo("Purging tiles with params " + strings.Join(params, "/") + "...")
+
+	start := time.Now()
+
+	var err error
+
+	if deleter, ok := c.Store.(tileStorePrefixDeleter); ok {
+		err = deleter.DeletePrefix(c.Route, params)
+	} else {
+		keys := []TileKey{}
+		err = c.Store.Iterate(c.Route, func(info TileInfo) error {
+			if hasParamsPrefix(info.Key.Params, params) {
+				keys = append(keys, info.Key)
+			}
+			return nil
+		})
+
+		for _, key := range keys {
+			if err != nil {
+				break
+			}
+
+			err = c.Store.Delete(key)
+		}
+	}
+
+	prefix := strings.Join(append(append([]string{}, c.Route...), params...), "/") + "/"
+	c.quota.removePrefix(prefix)
+
+	if c.SharedMemCache != nil && err == nil {
+		c.SharedMemCache.MemoryMapDeletePrefix(c.RouteString, prefix)
+	}
+
+	if err != nil {
+		c.logWarn("Could not purge tiles, reason: " + err.Error())
+	} else {
+		duration := time.Since(start)
+		c.logInfo("Tiles successfully purged! (took " + duration.String() + ")")
+	}
+
+	return err
+}
+
+func hasParamsPrefix(params []string, prefix []string) bool {
+	if len(params) < len(prefix) {
+		return false
+	}
+
+	for i := range prefix {
+		if params[i] != prefix[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *Cache) memoryMapLoad(requestIdPrefix string, requestParams *url.Values, x string, y string, z string) (*[]byte, time.Time, error) {
 	start := time.Now()
-	key := c.makeFilepath(requestParams, x, y, z).FullPath
+	key := c.makeTileKey(requestParams, x, y, z).String()
 
 	if c.SharedMemCache == nil {
 		msg := "SharedMemoryCache not set, cannot load tile with key [" + key + "] from memory map."
 		c.logDebug(requestIdPrefix + msg)
-		return nil, errors.New(msg)
+		return nil, time.Time{}, errors.New(msg)
 	}
 
-	data, exists := c.SharedMemCache.MemoryMapRead(c.RouteString, key)
+	tile, exists := c.SharedMemCache.MemoryMapReadTile(c.RouteString, key)
 
 	duration := time.Since(start)
 
-	if exists {
-		c.logDebug(requestIdPrefix + "Loaded tile from the MemoryMap with key [" + key + "] (took " + duration.String() + ")")
-		return data, nil
-	} else {
+	if !exists {
 		c.logDebug(requestIdPrefix + "Tile for key [" + key + "] not found in MemoryMap (took " + duration.String() + ")")
-		return nil, errors.New("Tile for key [" + key + "] not found in MemoryMap.")
+		return nil, time.Time{}, errors.New("Tile for key [" + key + "] not found in MemoryMap.")
+	}
+
+	if c.isFileOutdated(tile.Timestamp) {
+		c.logDebug(requestIdPrefix + "Tile with key [" + key + "] found in MemoryMap, but it is outdated (took " + duration.String() + ")")
+		return &tile.Data, tile.Timestamp, errTileOutdated
 	}
+
+	c.logDebug(requestIdPrefix + "Loaded tile from the MemoryMap with key [" + key + "] (took " + duration.String() + ")")
+	return &tile.Data, tile.Timestamp, nil
 }
 
-func (c *Cache) memoryMapStore(requestIdPrefix string, requestParams *url.Values, x string, y string, z string, data *[]byte) {
+func (c *Cache) memoryMapStore(requestIdPrefix string, requestParams *url.Values, x string, y string, z string, data *[]byte, timestamp time.Time) {
 	start := time.Now()
-	key := c.makeFilepath(requestParams, x, y, z).FullPath
+	key := c.makeTileKey(requestParams, x, y, z).String()
 
 	if c.SharedMemCache == nil {
 		msg := "SharedMemoryCache not set, cannot store tile with key [" + key + "] in memory map."
@@ -183,7 +654,7 @@ func (c *Cache) memoryMapStore(requestIdPrefix string, requestParams *url.Values
 		return
 	}
 
-	c.SharedMemCache.MemoryMapWrite(c.RouteString, key, data)
+	c.SharedMemCache.MemoryMapWriteTile(c.RouteString, key, data, timestamp)
 
 	duration := time.Since(start)
 	c.logDebug(requestIdPrefix + "Tile with " + strconv.Itoa(len(*data)) + " Bytes successfully saved to the MemoryMap with key [" + key + "] (took " + duration.String() + ")")
@@ -191,68 +662,33 @@ func (c *Cache) memoryMapStore(requestIdPrefix string, requestParams *url.Values
 
 func (c *Cache) isFileOutdated(modtime time.Time) bool {
 	age := time.Now().Sub(modtime)
-	return age > c.TimeToLive
+	return age > c.HardTimeToLive
 }
 
-func (c *Cache) ValidateCache() {
-	c.logInfo("Validating cache...")
-
-	start := time.Now()
-
-	root := filepath.Join(append([]string{"."}, c.Route...)...)
-
-	if _, statErr := os.Stat(root); statErr != nil {
-		c.logDebug("Cache directory not yet created. Aborting cleanup!")
-		return
+// needsRevalidation reports whether a tile that is not yet outdated should be
+// refreshed in the background.
+func (c *Cache) needsRevalidation(modtime time.Time) bool {
+	if c.SoftTimeToLive <= 0 || c.SoftTimeToLive >= c.HardTimeToLive {
+		return false
 	}
 
-	var totalSize int64 = 0
-	var removedFilesSize int64 = 0
-
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			size := info.Size()
-			infoString := fmt.Sprintf("Inspecting file [%s] => size: %d Bytes, modtime: %s", path, size, info.ModTime().String())
-			c.logDebug(infoString)
-
-			totalSize += size
-
-			if c.isFileOutdated(info.ModTime()) {
-				c.logDebug("[" + path + "] is outdated. Removing file from cache...")
-				removeErr := os.Remove(path)
-
-				if removeErr != nil {
-					c.logWarn("Could not remove [" + path + "]")
-					return nil
-				}
-
-				removedFilesSize += size
-
-				c.logDebug("Removed file [" + path + "]")
-			} else {
-				c.logDebug("File [" + path + "] is current.")
-			}
-		} else {
-			files, err := ioutil.ReadDir(path)
-			if err == nil && len(files) == 0 {
-				err = os.Remove(path)
-
-				if err == nil {
-					c.logDebug("Removed folder [" + path + "]")
-				}
-			}
-		}
+	age := time.Now().Sub(modtime)
+	return age > c.SoftTimeToLive
+}
 
-		return nil
-	})
+// isStaleUsable reports whether an outdated tile may still be served because
+// refreshing it failed.
+func (c *Cache) isStaleUsable(modtime time.Time) bool {
+	if c.MaxStaleAge == MAX_STALE_AGE_UNLIMITED {
+		return true
+	}
 
-	if err != nil {
-		c.logWarn("Could not clean cache, reason: " + err.Error())
-		return
+	if c.MaxStaleAge <= 0 {
+		return false
 	}
 
-	duration := time.Since(start)
-	c.logInfo(fmt.Sprintf("Cache validated and cleaned! (Size before: %d Bytes, Size now: %d Bytes, %d Bytes removed, took %s)", totalSize, totalSize-removedFilesSize, removedFilesSize, duration.String()))
+	staleness := time.Now().Sub(modtime) - c.HardTimeToLive
+	return staleness <= c.MaxStaleAge
 }
 
 func (c *Cache) PreloadMemoryMap() {
@@ -266,34 +702,39 @@ func (c *Cache) PreloadMemoryMap() {
 
 	start := time.Now()
 
-	root := filepath.Join(append([]string{"."}, c.Route...)...)
-
-	if _, statErr := os.Stat(root); statErr != nil {
-		c.logDebug("Cache directory not yet created. Aborting preload!")
-		return
-	}
-
 	var totalSize int64 = 0
 	tilesStored := 0
 
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			totalSize += info.Size()
-			data, err := ioutil.ReadFile(path)
+	err := c.Store.Iterate(c.Route, func(info TileInfo) error {
+		key := info.Key.String()
 
-			if err != nil {
-				c.logWarn("Could not preload file " + path + ", reason: " + err.Error())
-			} else {
-				if c.SharedMemCache.MaxSizeReachedMutex() {
-					return errors.New("SharedMemoryCache exceeded its max size during preload... Preload aborted after " + strconv.Itoa(tilesStored) + " tiles.")
-				}
-
-				c.SharedMemCache.MemoryMapWrite(c.RouteString, path, &data)
-				tilesStored++
-				c.logDebug("Preloaded " + strconv.Itoa(len(data)) + " bytes from file " + path + " into MemoryMap [" + c.RouteString + "] with tileKey [" + path + "].")
+		if info.Format == "" {
+			if c.NegativeTimeToLive > 0 && info.Meta != nil && info.Meta.IsNegative() && c.isNegativeEntryCurrent(info.Meta.FetchedAt) {
+				c.negatives.add(key, info.Meta.FetchedAt)
 			}
+			return nil
+		}
+
+		totalSize += info.Size
+		tile, err := c.Store.Get(info.Key)
+
+		if err == nil && tile.Meta != nil {
+			err = tile.Meta.Verify(tile.Data)
+		}
+
+		if err != nil {
+			c.logWarn("Could not preload tile " + key + ", reason: " + err.Error())
+			return nil
+		}
+
+		if c.SharedMemCache.MaxSizeReachedMutex() {
+			return errors.New("SharedMemoryCache exceeded its max size during preload... Preload aborted after " + strconv.Itoa(tilesStored) + " tiles.")
 		}
 
+		c.SharedMemCache.MemoryMapWriteTile(c.RouteString, key, &tile.Data, tileTimestamp(tile.Meta, tile.ModTime))
+		tilesStored++
+		c.logDebug("Preloaded " + strconv.Itoa(len(tile.Data)) + " bytes into MemoryMap [" + c.RouteString + "] with tileKey [" + key + "].")
+
 		return nil
 	})
 
@@ -306,7 +747,17 @@ func (c *Cache) PreloadMemoryMap() {
 	c.logInfo(fmt.Sprintf("Cache data preloaded into memory! %d Bytes loaded, %d tiles stored, took %s)", totalSize, tilesStored, duration.String()))
 }
 
-func (c *Cache) request(requestIdPrefix string, x string, y string, z string, s string, params *url.Values, sourceHeader *http.Header) (*[]byte, error) {
+// fetchResult is a tile returned by request. revalidated is set if the origin
+// answered 304 Not Modified and data is the cached tile.
+type fetchResult struct {
+	data        *[]byte
+	revalidated bool
+}
+
+// request fetches a tile from the origin. If cachedData is set, the request is
+// sent conditionally with the validators stored for the cached tile. If the
+// origin answers 304 Not Modified, the cached tile is refreshed and returned.
+func (c *Cache) request(ctx context.Context, requestIdPrefix string, x string, y string, z string, s string, params *url.Values, sourceHeader *http.Header, cachedData *[]byte) (*fetchResult, error) {
 	start := time.Now()
 
 	url := c.UrlScheme
@@ -320,14 +771,36 @@ func (c *Cache) request(requestIdPrefix string, x string, y string, z string, s
 	}
 	url = strings.Replace(url, "{apiKey}", c.ApiKey, 1)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		c.logError(requestIdPrefix + "Could not create request, reason: " + err.Error())
 		return nil, err
 	}
 
 	if c.ForwardHeaders {
-		req.Header = *sourceHeader
+		req.Header = sourceHeader.Clone()
+	}
+
+	// conditional headers of the client refer to the client's cache, not ours
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	if cachedData != nil {
+		info, statErr := c.Store.Stat(c.makeTileKey(params, x, y, z))
+
+		if statErr == nil && info.Meta != nil && (info.Meta.ETag != "" || info.Meta.LastModified != "") {
+			meta := info.Meta
+
+			if meta.ETag != "" {
+				req.Header.Set("If-None-Match", meta.ETag)
+			}
+
+			if meta.LastModified != "" {
+				req.Header.Set("If-Modified-Since", meta.LastModified)
+			}
+		} else {
+			cachedData = nil
+		}
 	}
 
 	query := req.URL.Query()
@@ -344,35 +817,58 @@ func (c *Cache) request(requestIdPrefix string, x string, y string, z string, s
 	c.logDebug(requestIdPrefix + "Requesting tile from " + req.URL.RequestURI())
 	c.logDebug(requestIdPrefix + fmt.Sprintf("Request Headers: %s", req.Header))
 
-	requestStart := time.Now()
-	c.logDebug(requestIdPrefix + "Starting request at [" + requestStart.String() + "]")
+	if !c.breaker.allow() {
+		c.logDebug(requestIdPrefix + "Circuit breaker is " + c.breaker.State().String() + ", will not request the origin.")
+		return nil, errCircuitOpen
+	}
 
-	resp, err := c.Client.Do(req)
+	resp, err := c.fetchOrigin(ctx, requestIdPrefix, req)
 
-	requestDuration := time.Since(requestStart)
-	c.logDebug(requestIdPrefix + "Request from [" + requestStart.String() + "] finished (took " + requestDuration.String() + ").")
+	switch {
+	case ctx.Err() != nil:
+		c.breaker.done(breakerIgnore)
+	case err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		c.breaker.done(breakerFailure)
+	default:
+		c.breaker.done(breakerSuccess)
+	}
 
 	if err != nil {
-		c.logError(requestIdPrefix + "Could not request tile, reason: " + err.Error())
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		c.logError(requestIdPrefix + "Could not request tile, bad status code: " + strconv.Itoa(resp.StatusCode))
-		return nil, err
+	originURL := req.URL.String()
+	if c.ApiKey != "" {
+		originURL = strings.Replace(originURL, c.ApiKey, "{apiKey}", -1)
 	}
 
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	if isNegativeStatus(resp.StatusCode) && c.NegativeTimeToLive > 0 {
+		c.storeNegative(requestIdPrefix, params, x, y, z, resp.StatusCode, originURL)
+		return nil, errTileNotAvailable
+	}
 
-	if err != nil {
-		c.logError(requestIdPrefix + "Could parse response body, reason: " + err.Error())
-		return nil, err
+	if resp.StatusCode == http.StatusNotModified && cachedData != nil {
+		c.logDebug(requestIdPrefix + "Tile not modified at origin, refreshing cached tile.")
+
+		c.addStats(func(stats *CacheStats) {
+			stats.RevalidatedTiles++
+		})
+
+		c.touch(requestIdPrefix, params, x, y, z, cachedData)
+		return &fetchResult{data: cachedData, revalidated: true}, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &originStatusError{StatusCode: resp.StatusCode}
 	}
 
+	bodyBytes := resp.Body
+
 	c.logDebug(requestIdPrefix + "Received " + strconv.Itoa(len(bodyBytes)) + " Bytes from " + url)
 
-	if !c.isValidTile(requestIdPrefix, &bodyBytes) {
+	format, valid := c.isValidTile(requestIdPrefix, &bodyBytes, resp.Header.Get("Content-Type"))
+
+	if !valid {
 		length := len(bodyBytes)
 		if length > 20 {
 			length = 20
@@ -380,121 +876,240 @@ func (c *Cache) request(requestIdPrefix string, x string, y string, z string, s
 
 		c.logDebug(requestIdPrefix + "Invalid response body received. First " + strconv.Itoa(length) + " bytes received: " + string(bodyBytes[:length+1]))
 
-		return nil, errors.New("Invalid response body received.")
+		return nil, errInvalidTile
 	}
 
-	go c.save(requestIdPrefix, params, x, y, z, &bodyBytes)
-	go c.memoryMapStore(requestIdPrefix, params, x, y, z, &bodyBytes)
+	meta := newTileMeta(bodyBytes, resp, format.ContentType(), originURL)
+	c.negatives.remove(c.makeTileKey(params, x, y, z).String())
+
+	// store in memory before returning, so that requests arriving right after
+	// a coalesced fetch has finished do not trigger another one
+	c.memoryMapStore(requestIdPrefix, params, x, y, z, &bodyBytes, time.Now())
+
+	c.persist(requestIdPrefix, func() error {
+		return c.save(requestIdPrefix, params, x, y, z, &bodyBytes, format, meta)
+	})
 
 	duration := time.Since(start)
 	c.logDebug(requestIdPrefix + "Serving " + strconv.Itoa(len(bodyBytes)) + " Bytes to client (took " + duration.String() + ")")
 
-	return &bodyBytes, nil
+	return &fetchResult{data: &bodyBytes}, nil
 }
 
-func (c *Cache) makeFilepath(requestParams *url.Values, x string, y string, z string) FilePath {
-	pathArray := append([]string{"."}, c.Route...)
+// revalidateInBackground refreshes a tile from the origin without blocking the
+// client. Only one refresh per tile runs at a time, refreshes are also
+// coalesced with concurrent foreground requests for the same tile.
+func (c *Cache) revalidateInBackground(requestIdPrefix string, x string, y string, z string, s string, params *url.Values, sourceHeader http.Header, cachedData *[]byte) {
+	key := c.makeTileKey(params, x, y, z).String()
+
+	// called from within serve, so inFlight cannot have reached zero yet
+	c.inFlight.Add(1)
+
+	started := c.flights.doAsync(c.fetchCtx, key, func(ctx context.Context) (*fetchResult, error) {
+		defer c.inFlight.Done()
+
+		c.logDebug(requestIdPrefix + "Refreshing tile with key [" + key + "] in the background...")
+		return c.request(ctx, requestIdPrefix, x, y, z, s, params, &sourceHeader, cachedData)
+	})
+
+	if started {
+		c.addStats(func(stats *CacheStats) {
+			stats.BackgroundRefreshes++
+		})
+	} else {
+		c.inFlight.Done()
+		c.logDebug(requestIdPrefix + "Tile with key [" + key + "] is already being refreshed.")
+	}
+}
+
+var illegalPathCharacters = regexp.MustCompile(`[<>:"\/\\|?*]`)
+
+// sanitizePathSegment makes a value from the request safe to be used as a
+// single path segment, "." and ".." would otherwise escape the cache dir.
+func sanitizePathSegment(value string) string {
+	value = illegalPathCharacters.ReplaceAllString(value, "-")
 
+	if value == "." || value == ".." {
+		value = strings.Repeat("-", len(value))
+	}
+
+	return value
+}
+
+func (c *Cache) makeTileKey(requestParams *url.Values, x string, y string, z string) TileKey {
 	var additionalSubfolders []string
 	for _, requiredKey := range c.StructureParams {
 		value := strings.TrimSpace(requestParams.Get(requiredKey))
 
 		if len(value) > 0 {
-			m1 := regexp.MustCompile(`[<>:"\/\\|?*]`)
-			value = m1.ReplaceAllString(value, "-")
-			additionalSubfolders = append(additionalSubfolders, value)
+			additionalSubfolders = append(additionalSubfolders, sanitizePathSegment(value))
 		}
 	}
 
-	pathArray = append(pathArray, additionalSubfolders...)
-	pathArray = append(pathArray, z, y)
-
-	path := filepath.Join(pathArray...)
-	fullPath := filepath.Join(path, x+".png")
-
-	return FilePath{
-		Path:     path,
-		FullPath: fullPath,
+	return TileKey{
+		Route:  c.Route,
+		Params: additionalSubfolders,
+		Z:      sanitizePathSegment(z),
+		Y:      sanitizePathSegment(y),
+		X:      sanitizePathSegment(x),
 	}
 }
 
-func isPathDangerous(path string) bool {
-	trimmedPath := strings.TrimSpace(path)
-	return trimmedPath == "" || trimmedPath == "/" || trimmedPath == "C:\\"
-}
-
-func (c *Cache) load(requestIdPrefix string, requestParams *url.Values, x string, y string, z string) (*[]byte, error) {
+// load reads a tile and its timestamp from the store. Outdated tiles are
+// returned together with errTileOutdated.
+func (c *Cache) load(requestIdPrefix string, requestParams *url.Values, x string, y string, z string) (*[]byte, time.Time, error) {
 	start := time.Now()
 
-	fp := c.makeFilepath(requestParams, x, y, z)
-	data, err := ioutil.ReadFile(fp.FullPath)
+	key := c.makeTileKey(requestParams, x, y, z)
+	tile, err := c.Store.Get(key)
 
 	if err != nil {
-		return nil, err
+		return nil, time.Time{}, err
 	}
 
-	if len(data) == 0 {
-		return nil, errors.New("File empty!")
+	if !c.acceptsFormat(tile.Format) {
+		return nil, time.Time{}, os.ErrNotExist
 	}
 
-	t, err := times.Stat(fp.FullPath)
+	if len(tile.Data) == 0 {
+		return nil, time.Time{}, errors.New("File empty!")
+	}
 
-	if err != nil {
-		return nil, err
+	if tile.Meta != nil {
+		verifyErr := tile.Meta.Verify(tile.Data)
+
+		if verifyErr != nil {
+			c.logWarn(requestIdPrefix + "Tile " + key.String() + " is corrupt, reason: " + verifyErr.Error())
+			return nil, time.Time{}, verifyErr
+		}
 	}
 
-	c.logDebug(requestIdPrefix + "ModTime for " + fp.FullPath + ": " + t.ModTime().String())
+	timestamp := tileTimestamp(tile.Meta, tile.ModTime)
+	c.logDebug(requestIdPrefix + "Timestamp for " + key.String() + ": " + timestamp.String())
 
-	if c.isFileOutdated(t.ModTime()) {
-		return nil, errors.New("Tile is too old!")
+	if c.isFileOutdated(timestamp) {
+		return &tile.Data, timestamp, errTileOutdated
 	}
 
 	duration := time.Since(start)
-	c.logDebug(requestIdPrefix + "Loaded tile from " + fp.FullPath + " (took " + duration.String() + ")")
+	c.logDebug(requestIdPrefix + "Loaded tile " + key.String() + " from store (took " + duration.String() + ")")
 
-	return &data, nil
+	return &tile.Data, timestamp, nil
 }
 
-func (c *Cache) isValidTile(requestIdPrefix string, bytes *[]byte) bool {
+func (c *Cache) isValidTile(requestIdPrefix string, bytes *[]byte, contentType string) (TileFormat, bool) {
 	if len(*bytes) < 4 {
 		c.logDebug(requestIdPrefix + "Tile invalid, response body was empty.")
-		return false
+		return "", false
 	}
 
-	header := strings.ToLower(string((*bytes)[1:4]))
-	if header != "png" {
-		c.logDebug(requestIdPrefix + "Tile invalid, header != [PNG], got [" + header + "] instead")
-		return false
+	format, known := sniffTileFormat(*bytes, contentType)
+	if !known {
+		c.logDebug(requestIdPrefix + "Tile invalid, unknown format (Content-Type [" + contentType + "])")
+		return "", false
 	}
 
-	return true
+	if !c.acceptsFormat(format) {
+		c.logDebug(requestIdPrefix + "Tile invalid, format [" + string(format) + "] is not accepted by this cache")
+		return "", false
+	}
+
+	err := c.Validator.Validate(*bytes, format)
+	if err != nil {
+		c.logDebug(requestIdPrefix + "Tile invalid, reason: " + err.Error())
+		return "", false
+	}
+
+	return format, true
 }
 
-func (c *Cache) save(requestIdPrefix string, requestParams *url.Values, x string, y string, z string, data *[]byte) error {
+func (c *Cache) save(requestIdPrefix string, requestParams *url.Values, x string, y string, z string, data *[]byte, format TileFormat, meta *TileMeta) error {
 	start := time.Now()
 
-	fp := c.makeFilepath(requestParams, x, y, z)
+	key := c.makeTileKey(requestParams, x, y, z)
 
-	c.logDebug(requestIdPrefix + "Saving " + strconv.Itoa(len(*data)) + " Bytes to filesystem at " + fp.FullPath)
+	c.logDebug(requestIdPrefix + "Saving " + strconv.Itoa(len(*data)) + " Bytes to store with key " + key.String())
 
-	dirErr := os.MkdirAll(fp.Path, os.ModePerm)
+	err := c.Store.Put(key, &StoredTile{
+		Data:   *data,
+		Format: format,
+		Meta:   meta,
+	})
 
-	if dirErr != nil {
-		c.logError(requestIdPrefix + "Could not save tile, reason: " + dirErr.Error())
-		return dirErr
+	if err != nil {
+		c.logError(requestIdPrefix + "Could not save tile, reason: " + err.Error())
+		return err
 	}
-	fileErr := ioutil.WriteFile(fp.FullPath, *data, 0644)
 
-	if fileErr != nil {
-		c.logError(requestIdPrefix + "Could not save tile, reason: " + fileErr.Error())
-		return fileErr
+	if c.quota.enabled() {
+		c.quota.add(key, int64(len(*data)), time.Now(), false)
 	}
 
 	duration := time.Since(start)
-	c.logDebug(requestIdPrefix + "Tile with " + strconv.Itoa(len(*data)) + " Bytes successfully saved to " + fp.FullPath + " (took " + duration.String() + ")")
+	c.logDebug(requestIdPrefix + "Tile with " + strconv.Itoa(len(*data)) + " Bytes successfully saved with key " + key.String() + " (took " + duration.String() + ")")
 	return nil
 }
 
+// touch marks a cached tile as fresh after the origin confirmed that it has not
+// been modified.
+func (c *Cache) touch(requestIdPrefix string, requestParams *url.Values, x string, y string, z string, data *[]byte) {
+	now := time.Now()
+
+	c.memoryMapStore(requestIdPrefix, requestParams, x, y, z, data, now)
+
+	key := c.makeTileKey(requestParams, x, y, z)
+
+	c.persist(requestIdPrefix, func() error {
+		info, err := c.Store.Stat(key)
+
+		if err != nil || info.Format == "" {
+			return nil
+		}
+
+		if info.Meta != nil {
+			info.Meta.FetchedAt = now
+			info.Meta.OriginStatus = http.StatusNotModified
+		}
+
+		if toucher, ok := c.Store.(tileStoreToucher); ok {
+			err = toucher.Touch(*info, now)
+		} else {
+			err = c.Store.Put(key, &StoredTile{
+				Data:    *data,
+				Format:  info.Format,
+				Meta:    info.Meta,
+				ModTime: now,
+			})
+		}
+
+		if err != nil {
+			c.logWarn(requestIdPrefix + "Could not refresh tile [" + key.String() + "], reason: " + err.Error())
+		} else if c.quota.enabled() {
+			c.quota.add(key, info.Size, now, false)
+		}
+
+		return err
+	})
+}
+
+// ServeHTTP implements http.Handler. Requests are expected in the format
+// /{route}/{s}/{z}/{y}/{x}/?params, i.e. the route prefix must not be stripped.
+func (c *Cache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c.closeMutex.RLock()
+	if c.closed {
+		c.closeMutex.RUnlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Service Unavailable"))
+		return
+	}
+	c.inFlight.Add(1)
+	c.closeMutex.RUnlock()
+
+	defer c.inFlight.Done()
+
+	c.serve(w, req)
+}
+
 func (c *Cache) serve(w http.ResponseWriter, req *http.Request) {
 	// route format: /{route}/{s}/{z}/{y}/{x}/?params
 	start := time.Now()
@@ -529,25 +1144,65 @@ func (c *Cache) serve(w http.ResponseWriter, req *http.Request) {
 	c.logDebug(requestIdPrefix + "Request params found : " + fmt.Sprint(params))
 
 	var data *[]byte
+	var timestamp time.Time
 	var err error
 
+	cacheStatus := "HIT"
+
+	// outdated tiles are kept as a fallback in case the origin fails
+	var staleData *[]byte
+	var staleTimestamp time.Time
+
 	//c.logDebug(requestIdPrefix + "Trying to load tile, total numbers tiles in this cache's memory map: " + strconv.Itoa(len(*(c.SharedMemCache.MemoryMaps)[c.RouteString].Tiles)))
-	data, err = c.memoryMapLoad(requestIdPrefix, &params, x, y, z)
+	data, timestamp, err = c.memoryMapLoad(requestIdPrefix, &params, x, y, z)
+
+	if err == errTileOutdated {
+		staleData, staleTimestamp = data, timestamp
+	}
+
+	fromMemory := err == nil && data != nil
+
+	if !fromMemory && c.Archive != nil {
+		var archiveErr error
+		data, archiveErr = c.loadFromArchive(requestIdPrefix, x, y, z)
+
+		if archiveErr == nil {
+			c.logDebug(requestIdPrefix + "Tile for x=[" + x + "], y=[" + y + "], z=[" + z + "] found in archive!")
+			c.addStats(func(stats *CacheStats) {
+				stats.BytesServedFromArchive += len(*data)
+			})
+			cacheStatus = "ARCHIVE"
+			timestamp, err = time.Now(), nil
+		}
+	}
+
+	if (err != nil || data == nil) && c.isNegativelyCached(requestIdPrefix, c.makeTileKey(&params, x, y, z)) {
+		c.serveNegative(w, requestIdPrefix)
+		return
+	}
 
 	if err != nil || data == nil {
 		c.logDebug(requestIdPrefix + "Could not load tile for x=[" + x + "], y=[" + y + "], z=[" + z + "] from MemoryMap, will try HDD...")
-		data, err = c.load(requestIdPrefix, &params, x, y, z)
+		data, timestamp, err = c.load(requestIdPrefix, &params, x, y, z)
+
+		if err == errTileOutdated && (staleData == nil || timestamp.After(staleTimestamp)) {
+			staleData, staleTimestamp = data, timestamp
+		}
 
 		if err != nil || data == nil {
 			c.logDebug(requestIdPrefix + "Could not load tile for x=[" + x + "], y=[" + y + "], z=[" + z + "] from HDD, will request it from server...")
 		} else {
 			c.logDebug(requestIdPrefix + "Tile for x=[" + x + "], y=[" + y + "], z=[" + z + "] found in HDD-Storage!")
-			c.Stats.BytesServedFromHDD += len(*data)
-			c.memoryMapStore(requestIdPrefix, &params, x, y, z, data)
+			c.addStats(func(stats *CacheStats) {
+				stats.BytesServedFromHDD += len(*data)
+			})
+			c.memoryMapStore(requestIdPrefix, &params, x, y, z, data, timestamp)
 		}
-	} else {
+	} else if fromMemory {
 		c.logDebug(requestIdPrefix + "Tile for x=[" + x + "], y=[" + y + "], z=[" + z + "] found in MemoryMap!")
-		c.Stats.BytesServedFromMemory += len(*data)
+		c.addStats(func(stats *CacheStats) {
+			stats.BytesServedFromMemory += len(*data)
+		})
 	}
 
 	if err != nil || data == nil {
@@ -558,24 +1213,90 @@ func (c *Cache) serve(w http.ResponseWriter, req *http.Request) {
 		}
 
 		c.logDebug(requestIdPrefix + "Could not load tile for x=[" + x + "], y=[" + y + "], z=[" + z + "], reason: " + errString)
+
+		if strings.TrimSpace(c.UrlScheme) == "" {
+			c.logDebug(requestIdPrefix + "No origin configured, tile is not available.")
+			c.serveError(w, requestIdPrefix, errTileNotInArchive)
+			return
+		}
+
 		c.logDebug(requestIdPrefix + "Sending request to server...")
 
 		sourceHeader := req.Header.Clone()
 
-		data, err = c.request(requestIdPrefix, x, y, z, s, &params, &sourceHeader)
+		key := c.makeTileKey(&params, x, y, z).String()
+		var result *fetchResult
+		var shared bool
 
-		if err != nil || data == nil {
+		// the fetch may outlive this request if other clients wait for it
+		c.inFlight.Add(1)
+
+		result, err, shared = c.flights.do(req.Context(), c.fetchCtx, key, func(ctx context.Context) (*fetchResult, error) {
+			defer c.inFlight.Done()
+			return c.request(ctx, requestIdPrefix, x, y, z, s, &params, &sourceHeader, staleData)
+		})
+
+		revalidated := false
+
+		if result != nil {
+			data, revalidated = result.data, result.revalidated
+		}
+
+		if shared {
+			c.inFlight.Done()
+			c.logDebug(requestIdPrefix + "Request for key [" + key + "] was coalesced with a concurrent request.")
+
+			c.addStats(func(stats *CacheStats) {
+				stats.CoalescedRequests++
+			})
+		}
+
+		if err == errTileNotAvailable {
+			c.serveNegative(w, requestIdPrefix)
+			return
+		} else if (err != nil || data == nil) && staleData != nil && (err == errCircuitOpen || c.isStaleUsable(staleTimestamp)) {
+			// while the breaker is open, expired tiles are served regardless of
+			// MaxStaleAge
+			c.logWarn(requestIdPrefix + "Could not fetch tile for x=[" + x + "], y=[" + y + "], z=[" + z + "], serving outdated tile from " + staleTimestamp.String() + " instead.")
+			c.addStats(func(stats *CacheStats) {
+				stats.BytesServedStale += len(*staleData)
+			})
+			cacheStatus = "STALE"
+			data = staleData
+			w.Header().Add("Warning", `110 - "Response is Stale"`)
+			w.Header().Add("Warning", `111 - "Revalidation Failed"`)
+		} else if err != nil || data == nil {
 			c.logWarn(requestIdPrefix + "Could not fetch tile for x=[" + x + "], y=[" + y + "], z=[" + z + "].")
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte("Not found"))
+			c.serveError(w, requestIdPrefix, err)
 			return
+		} else if revalidated {
+			c.logDebug(requestIdPrefix + "Tile for x=[" + x + "], y=[" + y + "], z=[" + z + "] not modified at origin, serving cached tile (" + strconv.Itoa(len(*data)) + " Bytes)!")
+			c.addStats(func(stats *CacheStats) {
+				stats.BytesServedFromCache += len(*data)
+			})
+			cacheStatus = "REVALIDATED"
 		} else {
 			c.logDebug(requestIdPrefix + "Fetched tile for x=[" + x + "], y=[" + y + "], z=[" + z + "] from server (" + strconv.Itoa(len(*data)) + " Bytes)!")
-			c.Stats.BytesServedFromOrigin += len(*data)
+			c.addStats(func(stats *CacheStats) {
+				stats.BytesServedFromOrigin += len(*data)
+			})
+			cacheStatus = "MISS"
 		}
 	} else {
 		c.logDebug(requestIdPrefix + "Loaded tile for x=[" + x + "], y=[" + y + "], z=[" + z + "] from cache (" + strconv.Itoa(len(*data)) + " Bytes)!")
-		c.Stats.BytesServedFromCache += len(*data)
+		c.addStats(func(stats *CacheStats) {
+			stats.BytesServedFromCache += len(*data)
+		})
+
+		if c.quota.enabled() {
+			c.quota.touch(c.makeTileKey(&params, x, y, z).String(), time.Now())
+		}
+
+		if c.needsRevalidation(timestamp) {
+			cacheStatus = "STALE"
+			w.Header().Add("Warning", `110 - "Response is Stale"`)
+			c.revalidateInBackground(requestIdPrefix, x, y, z, s, &params, req.Header.Clone(), data)
+		}
 	}
 
 	//c.LogStats()
@@ -584,7 +1305,11 @@ func (c *Cache) serve(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
-	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Type", c.contentType(*data))
+	if isGzipped(*data) {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Header().Set("X-Cache", cacheStatus)
 	w.Header().Set("Content-Length", strconv.Itoa(len(*data)))
 
 	duration := time.Since(start)
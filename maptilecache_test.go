@@ -0,0 +1,165 @@
+package maptilecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCloseDrainsInFlightRequests(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\ntile"))
+	}))
+	defer origin.Close()
+
+	c, err := NewHandler(CacheConfig{
+		Route:      []string{"osm"},
+		UrlScheme:  origin.URL + "/{z}/{x}/{y}.png",
+		TimeToLive: time.Hour,
+		CacheDir:   t.TempDir(),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+
+	go func() {
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest("GET", "/osm/a/1/0/1/", nil))
+		done <- rec
+	}()
+
+	// let the request reach the origin
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = c.Close(ctx)
+
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("expected 200 MISS, got %d %s (%s)", rec.Code, rec.Header().Get("X-Cache"), rec.Header().Get("X-Cache-Error"))
+		}
+	default:
+		t.Fatal("Close returned before the in-flight request was done")
+	}
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/osm/a/1/0/1/", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after Close, got %d", rec.Code)
+	}
+}
+
+func TestCloseCancelsFetchesOnTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer origin.Close()
+
+	c, err := NewHandler(CacheConfig{
+		Route:      []string{"osm"},
+		UrlScheme:  origin.URL + "/{z}/{x}/{y}.png",
+		TimeToLive: time.Hour,
+		CacheDir:   t.TempDir(),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/osm/a/1/0/1/", nil))
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := c.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("origin fetch was not cancelled after Close timed out")
+	}
+}
+
+func TestOpenBreakerServesExpiredTiles(t *testing.T) {
+	failing := make(chan struct{})
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-failing:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("\x89PNG\r\n\x1a\ntile"))
+		}
+	}))
+	defer origin.Close()
+
+	c, err := NewHandler(CacheConfig{
+		Route:                   []string{"osm"},
+		UrlScheme:               origin.URL + "/{z}/{x}/{y}.png",
+		TimeToLive:              50 * time.Millisecond,
+		CacheDir:                t.TempDir(),
+		BreakerFailureThreshold: 1,
+		BreakerOpenDuration:     time.Minute,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	if rec := serve("/osm/a/1/0/1/"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("expected MISS, got %d %s", rec.Code, rec.Header().Get("X-Cache"))
+	}
+
+	close(failing)
+	time.Sleep(100 * time.Millisecond)
+
+	// a failing miss opens the breaker
+	if rec := serve("/osm/a/1/1/1/"); rec.Code == http.StatusOK {
+		t.Fatalf("expected an error, got %d %s", rec.Code, rec.Header().Get("X-Cache"))
+	}
+
+	if c.BreakerState() != BREAKER_OPEN {
+		t.Fatalf("expected the breaker to be open, got %s", c.BreakerState())
+	}
+
+	rec := serve("/osm/a/1/0/1/")
+
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("expected 200 STALE, got %d %s (%s)", rec.Code, rec.Header().Get("X-Cache"), rec.Header().Get("X-Cache-Error"))
+	}
+}
@@ -0,0 +1,565 @@
+package maptilecache
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MBTILES_EXTENSION = ".mbtiles"
+const DEFAULT_MBTILES_DRIVER = "sqlite3"
+
+var mbtilesSchema = []string{
+	"CREATE TABLE IF NOT EXISTS metadata (name TEXT, value TEXT)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS metadata_name ON metadata (name)",
+	"CREATE TABLE IF NOT EXISTS tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS tile_index ON tiles (zoom_level, tile_column, tile_row)",
+	// not part of the spec, readers ignore additional tables
+	"CREATE TABLE IF NOT EXISTS tile_meta (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, updated_at INTEGER, meta TEXT)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS tile_meta_index ON tile_meta (zoom_level, tile_column, tile_row)",
+}
+
+// MBTilesStore is a TileStore that writes the tiles of a route into a single
+// MBTiles file {Dir}/{route}.mbtiles, see https://github.com/mapbox/mbtiles-spec.
+// Tiles requested with structure params are stored in
+// {Dir}/{route}/{params}.mbtiles. Tile metadata is kept in the additional
+// table tile_meta.
+//
+// The package does not import a SQLite driver. Register one, e.g. with
+// import _ "github.com/mattn/go-sqlite3", and set DriverName accordingly.
+type MBTilesStore struct {
+	Dir        string
+	DriverName string
+	Metadata   map[string]string
+	databases  map[string]*mbtilesDatabase
+	mutex      *sync.Mutex
+}
+
+type MBTilesStoreConfig struct {
+	Dir        string            // defaults to the working directory
+	DriverName string            // database/sql driver, defaults to DEFAULT_MBTILES_DRIVER
+	Metadata   map[string]string // additional rows for the metadata table, e.g. attribution or type
+}
+
+type mbtilesDatabase struct {
+	db   *sql.DB
+	path string
+}
+
+func NewMBTilesStore(config MBTilesStoreConfig) (*MBTilesStore, error) {
+	dir := config.Dir
+
+	if strings.TrimSpace(dir) == "" {
+		dir = "."
+	}
+
+	driverName := config.DriverName
+
+	if driverName == "" {
+		driverName = DEFAULT_MBTILES_DRIVER
+	}
+
+	registered := false
+	for _, driver := range sql.Drivers() {
+		if driver == driverName {
+			registered = true
+		}
+	}
+
+	if !registered {
+		return nil, errors.New("could not create MBTiles store, reason: sql driver [" + driverName + "] not registered")
+	}
+
+	return &MBTilesStore{
+		Dir:        dir,
+		DriverName: driverName,
+		Metadata:   config.Metadata,
+		databases:  make(map[string]*mbtilesDatabase),
+		mutex:      &sync.Mutex{},
+	}, nil
+}
+
+func (s *MBTilesStore) path(route []string, params []string) string {
+	parts := append([]string{s.Dir}, route...)
+	parts = append(parts, params...)
+
+	return filepath.Join(parts...) + MBTILES_EXTENSION
+}
+
+// open returns the database for the route and params. If create is false and
+// the file does not exist, os.ErrNotExist is returned.
+func (s *MBTilesStore) open(route []string, params []string, create bool) (*mbtilesDatabase, error) {
+	path := s.path(route, params)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if database, exists := s.databases[path]; exists {
+		return database, nil
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		if !create || !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open(s.DriverName, path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// a single connection serializes access, so concurrent writes do not fail
+	// with "database is locked"
+	db.SetMaxOpenConns(1)
+
+	statements := append([]string{"PRAGMA busy_timeout = 5000"}, mbtilesSchema...)
+	for _, statement := range statements {
+		if _, err = db.Exec(statement); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	metadata := map[string]string{
+		"name":    strings.Join(append(append([]string{}, route...), params...), "/"),
+		"version": "1.1",
+		"type":    "baselayer",
+	}
+	for name, value := range s.Metadata {
+		metadata[name] = value
+	}
+
+	for name, value := range metadata {
+		// keep values of existing files, e.g. imported ones
+		if _, err = db.Exec("INSERT OR IGNORE INTO metadata (name, value) VALUES (?, ?)", name, value); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	database := &mbtilesDatabase{
+		db:   db,
+		path: path,
+	}
+	s.databases[path] = database
+
+	return database, nil
+}
+
+// tileCoordinates converts the key to MBTiles coordinates, rows are counted
+// from the bottom (TMS). Coordinates outside of the zoom level are rejected.
+func tileCoordinates(key TileKey) (int, int, int, error) {
+	z, zErr := strconv.Atoi(key.Z)
+	x, xErr := strconv.Atoi(key.X)
+	y, yErr := strconv.Atoi(key.Y)
+
+	if zErr != nil || xErr != nil || yErr != nil || z < 0 || z > 30 || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return 0, 0, 0, errors.New("invalid tile coordinates for key [" + key.String() + "]")
+	}
+
+	return z, x, (1 << uint(z)) - 1 - y, nil
+}
+
+func mbtilesFormat(format TileFormat) string {
+	switch format {
+	case TILE_FORMAT_JPEG:
+		return "jpg"
+	case TILE_FORMAT_MVT:
+		return "pbf"
+	}
+
+	return string(format)
+}
+
+func (s *MBTilesStore) Get(key TileKey) (*StoredTile, error) {
+	z, x, row, err := tileCoordinates(key)
+
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	database, err := s.open(key.Route, key.Params, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	var updatedAt sql.NullInt64
+	var metaString sql.NullString
+
+	err = database.db.QueryRow("SELECT t.tile_data, m.updated_at, m.meta FROM tiles t LEFT JOIN tile_meta m ON m.zoom_level = t.zoom_level AND m.tile_column = t.tile_column AND m.tile_row = t.tile_row WHERE t.zoom_level = ? AND t.tile_column = ? AND t.tile_row = ?", z, x, row).Scan(&data, &updatedAt, &metaString)
+
+	if err == sql.ErrNoRows {
+		return nil, os.ErrNotExist
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	format, _ := sniffTileFormat(data, "")
+
+	return &StoredTile{
+		Data:    data,
+		Format:  format,
+		Meta:    parseMBTilesMeta(metaString),
+		ModTime: database.modTime(updatedAt),
+	}, nil
+}
+
+func (s *MBTilesStore) Put(key TileKey, tile *StoredTile) error {
+	z, x, row, err := tileCoordinates(key)
+
+	if err != nil {
+		return err
+	}
+
+	database, err := s.open(key.Route, key.Params, true)
+
+	if err != nil {
+		return err
+	}
+
+	var metaString sql.NullString
+
+	if tile.Meta != nil {
+		metaBytes, err := json.Marshal(tile.Meta)
+
+		if err != nil {
+			return err
+		}
+
+		metaString = sql.NullString{String: string(metaBytes), Valid: true}
+	}
+
+	modTime := tile.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	tx, err := database.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	if len(tile.Data) > 0 {
+		_, err = tx.Exec("INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)", z, x, row, tile.Data)
+	} else {
+		_, err = tx.Exec("DELETE FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", z, x, row)
+	}
+
+	if err == nil {
+		_, err = tx.Exec("INSERT OR REPLACE INTO tile_meta (zoom_level, tile_column, tile_row, updated_at, meta) VALUES (?, ?, ?, ?, ?)", z, x, row, modTime.UnixNano(), metaString)
+	}
+
+	if err == nil && len(tile.Data) > 0 {
+		_, err = tx.Exec("INSERT OR REPLACE INTO metadata (name, value) VALUES ('format', ?)", mbtilesFormat(tile.Format))
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Touch replaces the metadata of a stored tile, tile_data is not rewritten.
+func (s *MBTilesStore) Touch(info TileInfo, modTime time.Time) error {
+	z, x, row, err := tileCoordinates(info.Key)
+
+	if err != nil {
+		return err
+	}
+
+	database, err := s.open(info.Key.Route, info.Key.Params, false)
+
+	if err != nil {
+		return err
+	}
+
+	var metaString sql.NullString
+
+	if info.Meta != nil {
+		metaBytes, err := json.Marshal(info.Meta)
+
+		if err != nil {
+			return err
+		}
+
+		metaString = sql.NullString{String: string(metaBytes), Valid: true}
+	}
+
+	_, err = database.db.Exec("INSERT OR REPLACE INTO tile_meta (zoom_level, tile_column, tile_row, updated_at, meta) VALUES (?, ?, ?, ?, ?)", z, x, row, modTime.UnixNano(), metaString)
+
+	return err
+}
+
+func (s *MBTilesStore) Delete(key TileKey) error {
+	z, x, row, err := tileCoordinates(key)
+
+	if err != nil {
+		return nil
+	}
+
+	database, err := s.open(key.Route, key.Params, false)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"tiles", "tile_meta"} {
+		_, err = database.db.Exec("DELETE FROM "+table+" WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", z, x, row)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MBTilesStore) Stat(key TileKey) (*TileInfo, error) {
+	z, x, row, err := tileCoordinates(key)
+
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	database, err := s.open(key.Route, key.Params, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := database.query(key.Route, key.Params, "WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", z, x, row)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(infos) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	return &infos[0], nil
+}
+
+func (s *MBTilesStore) Iterate(route []string, fn func(info TileInfo) error) error {
+	paramsList, err := s.paramsList(route)
+
+	if err != nil {
+		return err
+	}
+
+	for _, params := range paramsList {
+		database, err := s.open(route, params, false)
+
+		if err != nil {
+			return err
+		}
+
+		// read all rows first, fn may modify the database
+		infos, err := database.query(route, params, "")
+
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			err = fn(info)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// paramsList returns the params of all MBTiles files of the route.
+func (s *MBTilesStore) paramsList(route []string) ([][]string, error) {
+	paramsList := [][]string{}
+
+	if _, err := os.Stat(s.path(route, nil)); err == nil {
+		paramsList = append(paramsList, nil)
+	}
+
+	dir := filepath.Join(append([]string{s.Dir}, route...)...)
+
+	if _, err := os.Stat(dir); err != nil {
+		return paramsList, nil
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, MBTILES_EXTENSION) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, strings.TrimSuffix(path, MBTILES_EXTENSION))
+
+		if err != nil {
+			return nil
+		}
+
+		paramsList = append(paramsList, strings.Split(filepath.ToSlash(rel), "/"))
+		return nil
+	})
+
+	return paramsList, err
+}
+
+// query returns the tiles and metadata-only entries matching where, which
+// refers to the columns zoom_level, tile_column and tile_row.
+func (d *mbtilesDatabase) query(route []string, params []string, where string, args ...interface{}) ([]TileInfo, error) {
+	query := "SELECT k.zoom_level, k.tile_column, k.tile_row, length(t.tile_data), substr(t.tile_data, 1, 16), m.updated_at, m.meta " +
+		"FROM (SELECT zoom_level, tile_column, tile_row FROM tiles " + where + " UNION SELECT zoom_level, tile_column, tile_row FROM tile_meta " + where + ") k " +
+		"LEFT JOIN tiles t ON t.zoom_level = k.zoom_level AND t.tile_column = k.tile_column AND t.tile_row = k.tile_row " +
+		"LEFT JOIN tile_meta m ON m.zoom_level = k.zoom_level AND m.tile_column = k.tile_column AND m.tile_row = k.tile_row " +
+		"ORDER BY k.zoom_level, k.tile_row DESC, k.tile_column"
+
+	rows, err := d.db.Query(query, append(args, args...)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	infos := []TileInfo{}
+
+	for rows.Next() {
+		var z, x, row int
+		var size sql.NullInt64
+		var header []byte
+		var updatedAt sql.NullInt64
+		var metaString sql.NullString
+
+		err = rows.Scan(&z, &x, &row, &size, &header, &updatedAt, &metaString)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var format TileFormat
+		if size.Valid {
+			format, _ = sniffTileFormat(header, "")
+		}
+
+		infos = append(infos, TileInfo{
+			Key: TileKey{
+				Route:  route,
+				Params: params,
+				Z:      strconv.Itoa(z),
+				Y:      strconv.Itoa((1 << uint(z)) - 1 - row),
+				X:      strconv.Itoa(x),
+			},
+			Format:  format,
+			Size:    size.Int64,
+			ModTime: d.modTime(updatedAt),
+			Meta:    parseMBTilesMeta(metaString),
+		})
+	}
+
+	return infos, rows.Err()
+}
+
+// modTime falls back to the file's modtime for tiles that were not written
+// by the cache, e.g. in imported files.
+func (d *mbtilesDatabase) modTime(updatedAt sql.NullInt64) time.Time {
+	if updatedAt.Valid {
+		return time.Unix(0, updatedAt.Int64)
+	}
+
+	if info, err := os.Stat(d.path); err == nil {
+		return info.ModTime()
+	}
+
+	return time.Time{}
+}
+
+func parseMBTilesMeta(metaString sql.NullString) *TileMeta {
+	if !metaString.Valid {
+		return nil
+	}
+
+	var meta TileMeta
+	if json.Unmarshal([]byte(metaString.String), &meta) != nil {
+		return nil
+	}
+
+	return &meta
+}
+
+// Clear closes and removes all MBTiles files of the route.
+func (s *MBTilesStore) Clear(route []string) error {
+	paramsList, err := s.paramsList(route)
+
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, params := range paramsList {
+		path := s.path(route, params)
+
+		if database, exists := s.databases[path]; exists {
+			database.db.Close()
+			delete(s.databases, path)
+		}
+
+		for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+			removeErr := os.Remove(path + suffix)
+
+			if removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+				err = removeErr
+			}
+		}
+	}
+
+	return err
+}
+
+// Close closes all open MBTiles files. Close the store after all caches using
+// it have been closed.
+func (s *MBTilesStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var err error
+
+	for path, database := range s.databases {
+		closeErr := database.db.Close()
+
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+
+		delete(s.databases, path)
+	}
+
+	return err
+}
@@ -0,0 +1,51 @@
+package maptilecache
+
+import "testing"
+
+func TestTileCoordinates(t *testing.T) {
+	tests := []struct {
+		key TileKey
+		z   int
+		x   int
+		row int
+		err bool
+	}{
+		{key: TileKey{Z: "0", Y: "0", X: "0"}, z: 0, x: 0, row: 0},
+		{key: TileKey{Z: "1", Y: "0", X: "1"}, z: 1, x: 1, row: 1},
+		{key: TileKey{Z: "1", Y: "1", X: "0"}, z: 1, x: 0, row: 0},
+		{key: TileKey{Z: "3", Y: "2", X: "5"}, z: 3, x: 5, row: 5},
+		{key: TileKey{Z: "3", Y: "7", X: "7"}, z: 3, x: 7, row: 0},
+		{key: TileKey{Z: "12", Y: "1763", X: "3423"}, z: 12, x: 3423, row: 2332},
+		{key: TileKey{Z: "30", Y: "0", X: "0"}, z: 30, x: 0, row: 1<<30 - 1},
+		{key: TileKey{Z: "31", Y: "0", X: "0"}, err: true},
+		{key: TileKey{Z: "-1", Y: "0", X: "0"}, err: true},
+		{key: TileKey{Z: "1", Y: "a", X: "0"}, err: true},
+		{key: TileKey{Z: "3", Y: "100", X: "5"}, err: true},
+		{key: TileKey{Z: "3", Y: "8", X: "0"}, err: true},
+		{key: TileKey{Z: "3", Y: "0", X: "8"}, err: true},
+		{key: TileKey{Z: "3", Y: "-1", X: "0"}, err: true},
+		{key: TileKey{Z: "3", Y: "0", X: "-1"}, err: true},
+		{key: TileKey{Z: "0", Y: "0", X: "1"}, err: true},
+		{key: TileKey{Z: "1", Y: "0", X: ""}, err: true},
+	}
+
+	for _, test := range tests {
+		z, x, row, err := tileCoordinates(test.key)
+
+		if test.err {
+			if err == nil {
+				t.Errorf("tileCoordinates(%s): expected an error, got %d/%d/%d", test.key.String(), z, x, row)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("tileCoordinates(%s): %s", test.key.String(), err)
+			continue
+		}
+
+		if z != test.z || x != test.x || row != test.row {
+			t.Errorf("tileCoordinates(%s): expected %d/%d/%d, got %d/%d/%d", test.key.String(), test.z, test.x, test.row, z, x, row)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package maptilecache
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errTileNotAvailable = errors.New("Tile not available at origin")
+
+// negativeCache remembers tiles that the origin answered with 404 or 204, so
+// they are not requested again until NegativeTimeToLive has passed.
+type negativeCache struct {
+	entries map[string]time.Time
+	mutex   *sync.RWMutex
+}
+
+func newNegativeCache() *negativeCache {
+	return &negativeCache{
+		entries: make(map[string]time.Time),
+		mutex:   &sync.RWMutex{},
+	}
+}
+
+func (n *negativeCache) add(key string, fetchedAt time.Time) {
+	n.mutex.Lock()
+	n.entries[key] = fetchedAt
+	n.mutex.Unlock()
+}
+
+func (n *negativeCache) get(key string) (time.Time, bool) {
+	n.mutex.RLock()
+	fetchedAt, exists := n.entries[key]
+	n.mutex.RUnlock()
+
+	return fetchedAt, exists
+}
+
+func (n *negativeCache) remove(key string) {
+	n.mutex.Lock()
+	delete(n.entries, key)
+	n.mutex.Unlock()
+}
+
+// prune removes the entries fetched before cutoff and returns their number.
+func (n *negativeCache) prune(cutoff time.Time) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	pruned := 0
+
+	for key, fetchedAt := range n.entries {
+		if fetchedAt.Before(cutoff) {
+			delete(n.entries, key)
+			pruned++
+		}
+	}
+
+	return pruned
+}
+
+func isNegativeStatus(statusCode int) bool {
+	return statusCode == http.StatusNotFound || statusCode == http.StatusNoContent
+}
+
+// IsNegative reports whether the metadata records that the origin had no tile.
+func (m *TileMeta) IsNegative() bool {
+	return isNegativeStatus(m.OriginStatus)
+}
+
+func (c *Cache) isNegativeEntryCurrent(fetchedAt time.Time) bool {
+	return time.Now().Sub(fetchedAt) <= c.NegativeTimeToLive
+}
+
+// initNegativePruner removes expired negative entries from memory every
+// NegativeTimeToLive, entries that are not requested again would stay forever
+// otherwise.
+func (c *Cache) initNegativePruner() {
+	if c.NegativeTimeToLive <= 0 {
+		return
+	}
+
+	c.inFlight.Add(1)
+
+	go func() {
+		defer c.inFlight.Done()
+
+		ticker := time.NewTicker(c.NegativeTimeToLive)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pruned := c.negatives.prune(time.Now().Add(-c.NegativeTimeToLive))
+				c.logDebug("Pruned " + strconv.Itoa(pruned) + " expired negative entries from memory.")
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+}
+
+// isNegativelyCached checks memory and the store for a current negative entry.
+func (c *Cache) isNegativelyCached(requestIdPrefix string, key TileKey) bool {
+	if c.NegativeTimeToLive <= 0 {
+		return false
+	}
+
+	keyString := key.String()
+
+	if fetchedAt, exists := c.negatives.get(keyString); exists {
+		if c.isNegativeEntryCurrent(fetchedAt) {
+			return true
+		}
+
+		c.negatives.remove(keyString)
+		return false
+	}
+
+	info, err := c.Store.Stat(key)
+
+	if err != nil || info.Format != "" || info.Meta == nil || !info.Meta.IsNegative() || !c.isNegativeEntryCurrent(info.Meta.FetchedAt) {
+		return false
+	}
+
+	c.logDebug(requestIdPrefix + "Found negative entry for key [" + keyString + "] in store.")
+	c.negatives.add(keyString, info.Meta.FetchedAt)
+
+	return true
+}
+
+// storeNegative records that the origin has no tile for the given coordinates.
+// Previously cached versions of the tile are removed.
+func (c *Cache) storeNegative(requestIdPrefix string, requestParams *url.Values, x string, y string, z string, statusCode int, originURL string) {
+	key := c.makeTileKey(requestParams, x, y, z)
+	keyString := key.String()
+	now := time.Now()
+
+	c.logDebug(requestIdPrefix + "Origin has no tile for key [" + keyString + "], storing negative entry.")
+
+	c.negatives.add(keyString, now)
+
+	if c.SharedMemCache != nil {
+		c.SharedMemCache.MemoryMapDelete(c.RouteString, keyString)
+	}
+
+	c.persist(requestIdPrefix, func() error {
+		err := c.Store.Put(key, &StoredTile{
+			Meta: &TileMeta{
+				FetchedAt:    now,
+				OriginURL:    originURL,
+				OriginStatus: statusCode,
+			},
+		})
+
+		if err != nil {
+			c.logError(requestIdPrefix + "Could not save negative entry, reason: " + err.Error())
+		}
+
+		return err
+	})
+}
+
+func (c *Cache) serveNegative(w http.ResponseWriter, requestIdPrefix string) {
+	c.addStats(func(stats *CacheStats) {
+		stats.NegativeHits++
+	})
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("X-Cache", "NEGATIVE")
+
+	if !c.NegativeEmptyTile {
+		c.logDebug(requestIdPrefix + "Tile not available at origin, answering with 404.")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	c.logDebug(requestIdPrefix + "Tile not available at origin, answering with an empty tile.")
+	data := c.emptyTile()
+
+	w.Header().Set("Content-Type", TILE_FORMAT_PNG.ContentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
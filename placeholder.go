@@ -0,0 +1,118 @@
+package maptilecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const DEFAULT_TILE_SIZE = 256
+
+type ErrorTileMode int
+
+const (
+	ERROR_TILE_NONE        ErrorTileMode = iota // plain text 404
+	ERROR_TILE_TRANSPARENT                      // transparent PNG of TileSize x TileSize pixels
+	ERROR_TILE_IMAGE                            // the configured ErrorTileImage
+)
+
+var errInvalidTile = errors.New("Invalid response body received.")
+
+type originStatusError struct {
+	StatusCode int
+}
+
+func (e *originStatusError) Error() string {
+	return "Could not request tile, bad status code: " + strconv.Itoa(e.StatusCode)
+}
+
+// emptyTile returns a fully transparent PNG of TileSize x TileSize pixels. It
+// is only encoded once per cache.
+func (c *Cache) emptyTile() []byte {
+	c.emptyTileOnce.Do(func() {
+		var buffer bytes.Buffer
+		img := image.NewNRGBA(image.Rect(0, 0, c.TileSize, c.TileSize))
+
+		err := png.Encode(&buffer, img)
+
+		if err != nil {
+			c.logError("Could not encode empty tile, reason: " + err.Error())
+			return
+		}
+
+		c.emptyTileData = buffer.Bytes()
+	})
+
+	return c.emptyTileData
+}
+
+// errorReason maps the error of a failed request to the value of the
+// X-Cache-Error header. Error messages are not exposed, they may contain the
+// origin's url including the api key.
+func errorReason(err error) string {
+	var statusErr *originStatusError
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return "unknown"
+	case err == errCircuitOpen:
+		return "circuit-open"
+	case err == errRateLimited:
+		return "rate-limited"
+	case err == errInvalidTile:
+		return "invalid-tile"
+	case err == errTileNotInArchive:
+		return "not-in-archive"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &statusErr):
+		return "origin-status-" + strconv.Itoa(statusErr.StatusCode)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+
+	return "origin-unavailable"
+}
+
+// serveError answers a request that could not be served from the cache or the
+// origin, depending on ErrorTile.
+func (c *Cache) serveError(w http.ResponseWriter, requestIdPrefix string, err error) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("X-Cache-Error", errorReason(err))
+
+	var data []byte
+	var contentType string
+
+	switch c.ErrorTile {
+	case ERROR_TILE_TRANSPARENT:
+		data = c.emptyTile()
+		contentType = TILE_FORMAT_PNG.ContentType()
+	case ERROR_TILE_IMAGE:
+		data = c.ErrorTileImage
+		contentType = c.contentType(data)
+	}
+
+	if len(data) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	c.logDebug(requestIdPrefix + "Answering with error tile.")
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Cache", "ERROR")
+	w.Write(data)
+}
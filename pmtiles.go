@@ -0,0 +1,447 @@
+package maptilecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const PMTILES_HEADER_SIZE = 127
+const DEFAULT_PMTILES_DIRECTORY_CACHE_SIZE = 64
+
+const (
+	PMTILES_COMPRESSION_UNKNOWN uint8 = 0
+	PMTILES_COMPRESSION_NONE    uint8 = 1
+	PMTILES_COMPRESSION_GZIP    uint8 = 2
+	PMTILES_COMPRESSION_BROTLI  uint8 = 3
+	PMTILES_COMPRESSION_ZSTD    uint8 = 4
+)
+
+const (
+	PMTILES_TILE_TYPE_UNKNOWN uint8 = 0
+	PMTILES_TILE_TYPE_MVT     uint8 = 1
+	PMTILES_TILE_TYPE_PNG     uint8 = 2
+	PMTILES_TILE_TYPE_JPEG    uint8 = 3
+	PMTILES_TILE_TYPE_WEBP    uint8 = 4
+	PMTILES_TILE_TYPE_AVIF    uint8 = 5
+)
+
+// the maximum depth of leaf directories is 3 according to the spec
+const pmtilesMaxDirectoryDepth = 4
+
+var errTileNotInArchive = errors.New("Tile not found in archive")
+
+// PMTilesHeader is the header of a PMTiles v3 archive, see
+// https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md.
+type PMTilesHeader struct {
+	SpecVersion         uint8
+	RootOffset          uint64
+	RootLength          uint64
+	MetadataOffset      uint64
+	MetadataLength      uint64
+	LeafDirectoryOffset uint64
+	LeafDirectoryLength uint64
+	TileDataOffset      uint64
+	TileDataLength      uint64
+	AddressedTilesCount uint64
+	TileEntriesCount    uint64
+	TileContentsCount   uint64
+	Clustered           bool
+	InternalCompression uint8
+	TileCompression     uint8
+	TileType            uint8
+	MinZoom             uint8
+	MaxZoom             uint8
+	MinLonE7            int32
+	MinLatE7            int32
+	MaxLonE7            int32
+	MaxLatE7            int32
+	CenterZoom          uint8
+	CenterLonE7         int32
+	CenterLatE7         int32
+}
+
+type pmtilesEntry struct {
+	TileID    uint64
+	Offset    uint64
+	Length    uint32
+	RunLength uint32
+}
+
+// PMTilesArchive reads tiles from a local PMTiles v3 archive. The root
+// directory is kept in memory, leaf directories are cached up to
+// DirectoryCacheSize.
+type PMTilesArchive struct {
+	Path               string
+	Header             PMTilesHeader
+	DirectoryCacheSize int
+	file               *os.File
+	root               []pmtilesEntry
+	leaves             map[uint64][]pmtilesEntry
+	leafOrder          []uint64
+	mutex              *sync.Mutex
+}
+
+type PMTilesArchiveConfig struct {
+	Path               string
+	DirectoryCacheSize int // number of cached leaf directories, defaults to DEFAULT_PMTILES_DIRECTORY_CACHE_SIZE
+}
+
+func NewPMTilesArchive(config PMTilesArchiveConfig) (*PMTilesArchive, error) {
+	directoryCacheSize := config.DirectoryCacheSize
+
+	if directoryCacheSize <= 0 {
+		directoryCacheSize = DEFAULT_PMTILES_DIRECTORY_CACHE_SIZE
+	}
+
+	file, err := os.Open(config.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	a := PMTilesArchive{
+		Path:               config.Path,
+		DirectoryCacheSize: directoryCacheSize,
+		file:               file,
+		leaves:             make(map[uint64][]pmtilesEntry),
+		leafOrder:          []uint64{},
+		mutex:              &sync.Mutex{},
+	}
+
+	headerBytes := make([]byte, PMTILES_HEADER_SIZE)
+	_, err = file.ReadAt(headerBytes, 0)
+
+	if err == nil {
+		a.Header, err = parsePMTilesHeader(headerBytes)
+	}
+
+	if err == nil {
+		a.root, err = a.readDirectory(a.Header.RootOffset, a.Header.RootLength)
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, errors.New("could not open PMTiles archive [" + config.Path + "], reason: " + err.Error())
+	}
+
+	return &a, nil
+}
+
+func parsePMTilesHeader(data []byte) (PMTilesHeader, error) {
+	if len(data) < PMTILES_HEADER_SIZE || string(data[0:7]) != "PMTiles" {
+		return PMTilesHeader{}, errors.New("not a PMTiles archive")
+	}
+
+	if data[7] != 3 {
+		return PMTilesHeader{}, errors.New("unsupported PMTiles version " + strconv.Itoa(int(data[7])))
+	}
+
+	u64 := func(offset int) uint64 {
+		return binary.LittleEndian.Uint64(data[offset : offset+8])
+	}
+
+	i32 := func(offset int) int32 {
+		return int32(binary.LittleEndian.Uint32(data[offset : offset+4]))
+	}
+
+	return PMTilesHeader{
+		SpecVersion:         data[7],
+		RootOffset:          u64(8),
+		RootLength:          u64(16),
+		MetadataOffset:      u64(24),
+		MetadataLength:      u64(32),
+		LeafDirectoryOffset: u64(40),
+		LeafDirectoryLength: u64(48),
+		TileDataOffset:      u64(56),
+		TileDataLength:      u64(64),
+		AddressedTilesCount: u64(72),
+		TileEntriesCount:    u64(80),
+		TileContentsCount:   u64(88),
+		Clustered:           data[96] == 1,
+		InternalCompression: data[97],
+		TileCompression:     data[98],
+		TileType:            data[99],
+		MinZoom:             data[100],
+		MaxZoom:             data[101],
+		MinLonE7:            i32(102),
+		MinLatE7:            i32(106),
+		MaxLonE7:            i32(110),
+		MaxLatE7:            i32(114),
+		CenterZoom:          data[118],
+		CenterLonE7:         i32(119),
+		CenterLatE7:         i32(123),
+	}, nil
+}
+
+func (a *PMTilesArchive) read(offset uint64, length uint64) ([]byte, error) {
+	data := make([]byte, length)
+	_, err := a.file.ReadAt(data, int64(offset))
+
+	return data, err
+}
+
+func decompress(data []byte, compression uint8) ([]byte, error) {
+	switch compression {
+	case PMTILES_COMPRESSION_NONE, PMTILES_COMPRESSION_UNKNOWN:
+		return data, nil
+	case PMTILES_COMPRESSION_GZIP:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+
+	return nil, errors.New("unsupported compression " + strconv.Itoa(int(compression)))
+}
+
+func (a *PMTilesArchive) readDirectory(offset uint64, length uint64) ([]pmtilesEntry, error) {
+	data, err := a.read(offset, length)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = decompress(data, a.Header.InternalCompression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePMTilesDirectory(data)
+}
+
+func parsePMTilesDirectory(data []byte) ([]pmtilesEntry, error) {
+	reader := bytes.NewReader(data)
+
+	numEntries, err := binary.ReadUvarint(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if numEntries > uint64(len(data)) {
+		return nil, errors.New("invalid directory, too many entries")
+	}
+
+	entries := make([]pmtilesEntry, numEntries)
+
+	var lastID uint64 = 0
+	for i := range entries {
+		value, err := binary.ReadUvarint(reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		lastID += value
+		entries[i].TileID = lastID
+	}
+
+	for i := range entries {
+		value, err := binary.ReadUvarint(reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries[i].RunLength = uint32(value)
+	}
+
+	for i := range entries {
+		value, err := binary.ReadUvarint(reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries[i].Length = uint32(value)
+	}
+
+	for i := range entries {
+		value, err := binary.ReadUvarint(reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// 0 means the entry directly follows the previous one
+		if value == 0 && i > 0 {
+			entries[i].Offset = entries[i-1].Offset + uint64(entries[i-1].Length)
+		} else {
+			entries[i].Offset = value - 1
+		}
+	}
+
+	return entries, nil
+}
+
+// findEntry returns the entry covering tileID, which is either a tile or a
+// leaf directory (RunLength == 0).
+func findEntry(entries []pmtilesEntry, tileID uint64) (pmtilesEntry, bool) {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].TileID > tileID
+	}) - 1
+
+	if i < 0 {
+		return pmtilesEntry{}, false
+	}
+
+	entry := entries[i]
+
+	if entry.RunLength == 0 || tileID-entry.TileID < uint64(entry.RunLength) {
+		return entry, true
+	}
+
+	return pmtilesEntry{}, false
+}
+
+func (a *PMTilesArchive) leafDirectory(entry pmtilesEntry) ([]pmtilesEntry, error) {
+	a.mutex.Lock()
+	leaf, exists := a.leaves[entry.Offset]
+	a.mutex.Unlock()
+
+	if exists {
+		return leaf, nil
+	}
+
+	leaf, err := a.readDirectory(a.Header.LeafDirectoryOffset+entry.Offset, uint64(entry.Length))
+
+	if err != nil {
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	if _, exists := a.leaves[entry.Offset]; !exists {
+		if len(a.leafOrder) >= a.DirectoryCacheSize {
+			delete(a.leaves, a.leafOrder[0])
+			a.leafOrder = a.leafOrder[1:]
+		}
+
+		a.leaves[entry.Offset] = leaf
+		a.leafOrder = append(a.leafOrder, entry.Offset)
+	}
+	a.mutex.Unlock()
+
+	return leaf, nil
+}
+
+// zxyToTileID converts tile coordinates to a PMTiles tile id, which numbers
+// the tiles of all zoom levels along a Hilbert curve.
+func zxyToTileID(z uint8, x uint32, y uint32) uint64 {
+	var id uint64 = ((1 << (uint64(z) * 2)) - 1) / 3
+	n := uint32(1) << z
+
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint32
+
+		if x&s > 0 {
+			rx = 1
+		}
+
+		if y&s > 0 {
+			ry = 1
+		}
+
+		id += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+
+		if ry == 0 {
+			if rx == 1 {
+				x = n - 1 - x
+				y = n - 1 - y
+			}
+
+			x, y = y, x
+		}
+	}
+
+	return id
+}
+
+// Tile returns the tile at z/x/y. Gzipped vector tiles are returned
+// compressed, other tiles are decompressed. If the archive does not contain
+// the tile, errTileNotInArchive is returned.
+func (a *PMTilesArchive) Tile(z int, x int, y int) ([]byte, error) {
+	if z < int(a.Header.MinZoom) || z > int(a.Header.MaxZoom) || z > 31 || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return nil, errTileNotInArchive
+	}
+
+	tileID := zxyToTileID(uint8(z), uint32(x), uint32(y))
+	entries := a.root
+
+	for depth := 0; depth < pmtilesMaxDirectoryDepth; depth++ {
+		entry, found := findEntry(entries, tileID)
+
+		if !found {
+			return nil, errTileNotInArchive
+		}
+
+		if entry.RunLength > 0 {
+			data, err := a.read(a.Header.TileDataOffset+entry.Offset, uint64(entry.Length))
+
+			if err != nil {
+				return nil, err
+			}
+
+			if a.Header.TileType == PMTILES_TILE_TYPE_MVT && a.Header.TileCompression == PMTILES_COMPRESSION_GZIP {
+				return data, nil
+			}
+
+			return decompress(data, a.Header.TileCompression)
+		}
+
+		leaf, err := a.leafDirectory(entry)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = leaf
+	}
+
+	return nil, errTileNotInArchive
+}
+
+func (a *PMTilesArchive) Close() error {
+	return a.file.Close()
+}
+
+// loadFromArchive reads a tile from the cache's PMTiles archive.
+func (c *Cache) loadFromArchive(requestIdPrefix string, x string, y string, z string) (*[]byte, error) {
+	if c.Archive == nil {
+		return nil, errTileNotInArchive
+	}
+
+	zInt, zErr := strconv.Atoi(z)
+	xInt, xErr := strconv.Atoi(x)
+	yInt, yErr := strconv.Atoi(y)
+
+	if zErr != nil || xErr != nil || yErr != nil {
+		return nil, errTileNotInArchive
+	}
+
+	data, err := c.Archive.Tile(zInt, xInt, yInt)
+
+	if err != nil {
+		if err != errTileNotInArchive {
+			c.logWarn(requestIdPrefix + "Could not read tile from archive, reason: " + err.Error())
+		}
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, errTileNotInArchive
+	}
+
+	return &data, nil
+}
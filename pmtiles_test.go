@@ -0,0 +1,199 @@
+package maptilecache
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func pmtilesTestHeader() []byte {
+	data := make([]byte, PMTILES_HEADER_SIZE)
+	copy(data, "PMTiles")
+	data[7] = 3
+
+	for i, value := range []uint64{127, 25, 152, 40, 192, 0, 192, 1000, 2, 2, 2} {
+		binary.LittleEndian.PutUint64(data[8+8*i:], value)
+	}
+
+	data[96] = 1
+	data[97] = PMTILES_COMPRESSION_GZIP
+	data[98] = PMTILES_COMPRESSION_NONE
+	data[99] = PMTILES_TILE_TYPE_PNG
+	data[100] = 0
+	data[101] = 14
+
+	for i, value := range []int32{-1800000000, -850511287, 1800000000, 850511287} {
+		binary.LittleEndian.PutUint32(data[102+4*i:], uint32(value))
+	}
+
+	data[118] = 3
+	binary.LittleEndian.PutUint32(data[119:], uint32(int32(134000000)))
+	binary.LittleEndian.PutUint32(data[123:], uint32(int32(524000000)))
+
+	return data
+}
+
+func TestParsePMTilesHeader(t *testing.T) {
+	valid := pmtilesTestHeader()
+
+	version2 := pmtilesTestHeader()
+	version2[7] = 2
+
+	badMagic := pmtilesTestHeader()
+	copy(badMagic, "MBTiles")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected PMTilesHeader
+		err      bool
+	}{
+		{
+			name: "valid",
+			data: valid,
+			expected: PMTilesHeader{
+				SpecVersion:         3,
+				RootOffset:          127,
+				RootLength:          25,
+				MetadataOffset:      152,
+				MetadataLength:      40,
+				LeafDirectoryOffset: 192,
+				LeafDirectoryLength: 0,
+				TileDataOffset:      192,
+				TileDataLength:      1000,
+				AddressedTilesCount: 2,
+				TileEntriesCount:    2,
+				TileContentsCount:   2,
+				Clustered:           true,
+				InternalCompression: PMTILES_COMPRESSION_GZIP,
+				TileCompression:     PMTILES_COMPRESSION_NONE,
+				TileType:            PMTILES_TILE_TYPE_PNG,
+				MinZoom:             0,
+				MaxZoom:             14,
+				MinLonE7:            -1800000000,
+				MinLatE7:            -850511287,
+				MaxLonE7:            1800000000,
+				MaxLatE7:            850511287,
+				CenterZoom:          3,
+				CenterLonE7:         134000000,
+				CenterLatE7:         524000000,
+			},
+		},
+		{name: "too short", data: valid[:PMTILES_HEADER_SIZE-1], err: true},
+		{name: "wrong magic", data: badMagic, err: true},
+		{name: "unsupported version", data: version2, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, err := parsePMTilesHeader(test.data)
+
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", header)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if header != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, header)
+			}
+		})
+	}
+}
+
+func TestParsePMTilesDirectory(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []pmtilesEntry
+		err      bool
+	}{
+		{
+			name:     "empty",
+			data:     []byte{0},
+			expected: []pmtilesEntry{},
+		},
+		{
+			// tile ids are delta encoded, offset 0 continues after the
+			// previous entry, other offsets are stored + 1
+			name: "entries",
+			data: []byte{
+				3,       // number of entries
+				0, 1, 4, // tile id deltas
+				1, 2, 0, // run lengths
+				10, 20, 30, // lengths
+				1, 0, 101, // offsets
+			},
+			expected: []pmtilesEntry{
+				{TileID: 0, Offset: 0, Length: 10, RunLength: 1},
+				{TileID: 1, Offset: 10, Length: 20, RunLength: 2},
+				{TileID: 5, Offset: 100, Length: 30, RunLength: 0},
+			},
+		},
+		{
+			name: "multi byte varints",
+			data: []byte{
+				1,
+				0xac, 0x02, // 300
+				1,
+				0x80, 0x01, // 128
+				0x81, 0x80, 0x04, // 65537
+			},
+			expected: []pmtilesEntry{
+				{TileID: 300, Offset: 65536, Length: 128, RunLength: 1},
+			},
+		},
+		{name: "truncated", data: []byte{2, 0, 1, 1}, err: true},
+		{name: "too many entries", data: []byte{0xff, 0x01, 0}, err: true},
+		{name: "no data", data: []byte{}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := parsePMTilesDirectory(test.data)
+
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", entries)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(entries, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, entries)
+			}
+		})
+	}
+}
+
+func TestZxyToTileID(t *testing.T) {
+	tests := []struct {
+		z        uint8
+		x        uint32
+		y        uint32
+		expected uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1},
+		{1, 0, 1, 2},
+		{1, 1, 1, 3},
+		{1, 1, 0, 4},
+		{2, 0, 0, 5},
+		{12, 3423, 1763, 19078479},
+	}
+
+	for _, test := range tests {
+		if id := zxyToTileID(test.z, test.x, test.y); id != test.expected {
+			t.Errorf("zxyToTileID(%d, %d, %d): expected %d, got %d", test.z, test.x, test.y, test.expected, id)
+		}
+	}
+}
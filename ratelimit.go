@@ -0,0 +1,118 @@
+package maptilecache
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var errRateLimited = errors.New("origin rate limit exceeded, request would exceed its deadline")
+
+// originLimiter bounds the number of concurrent origin connections and the
+// rate of origin requests (token bucket). A zero value for either limit
+// disables it.
+type originLimiter struct {
+	slots     chan struct{}
+	rate      float64
+	burst     float64
+	tokens    float64
+	lastCheck time.Time
+	mutex     *sync.Mutex
+}
+
+func newOriginLimiter(maxConnections int, requestsPerSecond float64, burst int) *originLimiter {
+	l := originLimiter{
+		rate:      requestsPerSecond,
+		burst:     float64(burst),
+		lastCheck: time.Now(),
+		mutex:     &sync.Mutex{},
+	}
+
+	if maxConnections > 0 {
+		l.slots = make(chan struct{}, maxConnections)
+	}
+
+	if l.burst < 1 {
+		l.burst = 1
+	}
+
+	l.tokens = l.burst
+
+	return &l
+}
+
+// acquire blocks until a request may be sent to the origin or ctx is done.
+// Every successful acquire must be followed by a release.
+func (l *originLimiter) acquire(ctx context.Context) error {
+	err := l.waitForToken(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if l.slots == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *originLimiter) release() {
+	if l.slots == nil {
+		return
+	}
+
+	<-l.slots
+}
+
+func (l *originLimiter) waitForToken(ctx context.Context) error {
+	if l.rate <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.lastCheck).Seconds()*l.rate)
+	l.lastCheck = now
+
+	// reserve a token, a negative balance queues the request
+	l.tokens--
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && now.Add(wait).After(deadline) {
+		l.cancelReservation()
+		return errRateLimited
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.cancelReservation()
+		return ctx.Err()
+	}
+}
+
+func (l *originLimiter) cancelReservation() {
+	l.mutex.Lock()
+	l.tokens++
+	l.mutex.Unlock()
+}
@@ -0,0 +1,167 @@
+package maptilecache
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const DEFAULT_ORIGIN_RETRY_BASE_DELAY = 250 * time.Millisecond
+const DEFAULT_ORIGIN_RETRY_MAX_DELAY = 10 * time.Second
+
+type originResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// parseRetryAfter supports both formats of the Retry-After header, delay
+// seconds and http dates.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// retryDelay returns an exponential backoff with equal jitter, i.e. a random
+// delay between half and the full backoff for the given attempt.
+func (c *Cache) retryDelay(attempt int) time.Duration {
+	backoff := c.OriginRetryMaxDelay
+	if attempt < 32 && c.OriginRetryBaseDelay<<uint(attempt) < c.OriginRetryMaxDelay {
+		backoff = c.OriginRetryBaseDelay << uint(attempt)
+	}
+
+	half := backoff / 2
+	if half <= 0 {
+		return backoff
+	}
+
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// fetchOrigin sends req to the origin and retries transport errors and
+// transient status codes up to OriginMaxRetries times. The response of the
+// last attempt is returned, an error is only returned if no response could be
+// received at all.
+func (c *Cache) fetchOrigin(ctx context.Context, requestIdPrefix string, req *http.Request) (*originResponse, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.fetchOriginOnce(ctx, requestIdPrefix, req.Clone(ctx))
+
+		if ctx.Err() != nil {
+			return resp, ctx.Err()
+		}
+
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+
+		if attempt >= c.OriginMaxRetries {
+			return resp, err
+		}
+
+		delay := c.retryDelay(attempt)
+
+		if err == nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+				if retryAfter > c.OriginRetryMaxDelay {
+					c.logWarn(requestIdPrefix + "Origin asked to retry after " + retryAfter.String() + ", which exceeds the max retry delay. Giving up.")
+					return resp, nil
+				}
+				delay = retryAfter
+			}
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			c.logWarn(requestIdPrefix + "Retrying after " + delay.String() + " would exceed the request's deadline. Giving up.")
+			return resp, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = "status code " + strconv.Itoa(resp.StatusCode)
+		}
+
+		c.logInfo(requestIdPrefix + "Origin request failed (" + reason + "), retry " + strconv.Itoa(attempt+1) + "/" + strconv.Itoa(c.OriginMaxRetries) + " in " + delay.String() + "...")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, ctx.Err()
+		}
+	}
+}
+
+func (c *Cache) fetchOriginOnce(ctx context.Context, requestIdPrefix string, req *http.Request) (*originResponse, error) {
+	queueStart := time.Now()
+	err := c.originLimiter.acquire(ctx)
+
+	if err != nil {
+		c.logWarn(requestIdPrefix + "Could not request tile, origin limit not available, reason: " + err.Error())
+		return nil, err
+	}
+
+	defer c.originLimiter.release()
+
+	c.logDebug(requestIdPrefix + "Waited " + time.Since(queueStart).String() + " for origin limiter.")
+
+	requestStart := time.Now()
+	c.logDebug(requestIdPrefix + "Starting request at [" + requestStart.String() + "]")
+
+	resp, err := c.Client.Do(req)
+
+	requestDuration := time.Since(requestStart)
+	c.logDebug(requestIdPrefix + "Request from [" + requestStart.String() + "] finished (took " + requestDuration.String() + ").")
+
+	if err != nil {
+		c.logError(requestIdPrefix + "Could not request tile, reason: " + err.Error())
+		return nil, err
+	}
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		c.logError(requestIdPrefix + "Could parse response body, reason: " + err.Error())
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		c.logError(requestIdPrefix + "Could not request tile, bad status code: " + strconv.Itoa(resp.StatusCode))
+	}
+
+	return &originResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       bodyBytes,
+	}, nil
+}
@@ -0,0 +1,650 @@
+package maptilecache
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_S3_REGION = "us-east-1"
+const DEFAULT_S3_HTTP_CLIENT_TIMEOUT = 10 * time.Second
+
+// maximum number of keys per ListObjectsV2 and DeleteObjects request
+const s3MaxKeys = 1000
+
+const (
+	s3MetaFetchedAt    = "X-Amz-Meta-Fetched-At"
+	s3MetaETag         = "X-Amz-Meta-Origin-Etag"
+	s3MetaLastModified = "X-Amz-Meta-Origin-Last-Modified"
+	s3MetaOriginURL    = "X-Amz-Meta-Origin-Url"
+	s3MetaOriginStatus = "X-Amz-Meta-Origin-Status"
+	s3MetaChecksum     = "X-Amz-Meta-Checksum"
+	s3MetaSize         = "X-Amz-Meta-Size"
+)
+
+// S3Store is a TileStore backed by an S3-compatible bucket (e.g. AWS S3 or
+// MinIO), so several cache instances can share their tiles. Objects use the
+// same layout as the FileStore, {Prefix}{route}/{params}/{z}/{y}/{x}.{ext}.
+// The tile's metadata is stored as object metadata (x-amz-meta-*), negative
+// entries are stored as {x}.meta.json. Single tiles are addressed directly
+// by trying the store's Formats in order, so Formats has to contain every
+// format the cache accepts, only Iterate and DeletePrefix list the bucket.
+//
+// Writes are conditional: new tiles are only created if no other instance
+// has created them in the meantime, existing tiles are only replaced if they
+// have not been replaced by a more recent version.
+type S3Store struct {
+	Endpoint         string
+	Bucket           string
+	Region           string
+	Prefix           string
+	AccessKey        string
+	SecretKey        string
+	VirtualHostStyle bool
+	Formats          []TileFormat
+	Client           *http.Client
+}
+
+type S3StoreConfig struct {
+	Endpoint          string // e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Bucket            string
+	Region            string // defaults to DEFAULT_S3_REGION
+	Prefix            string // prepended to all object keys, e.g. "tiles/"
+	AccessKey         string
+	SecretKey         string
+	VirtualHostStyle  bool         // use https://{bucket}.{host}/{key} instead of https://{host}/{bucket}/{key}
+	Formats           []TileFormat // formats stored in the bucket, defaults to DEFAULT_TILE_FORMATS
+	HttpClientTimeout time.Duration
+}
+
+type s3Object struct {
+	Key          string
+	LastModified time.Time
+	ETag         string
+	Size         int64
+}
+
+type s3ListResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+type s3DeleteObject struct {
+	Key string `xml:"Key"`
+}
+
+type s3DeleteRequest struct {
+	XMLName xml.Name         `xml:"Delete"`
+	Quiet   bool             `xml:"Quiet"`
+	Objects []s3DeleteObject `xml:"Object"`
+}
+
+type s3DeleteResult struct {
+	Errors []struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+var errS3PreconditionFailed = errors.New("precondition failed")
+
+func NewS3Store(config S3StoreConfig) (*S3Store, error) {
+	if strings.TrimSpace(config.Endpoint) == "" || strings.TrimSpace(config.Bucket) == "" {
+		return nil, errors.New("could not create S3 store, reason: endpoint and/or bucket not defined")
+	}
+
+	if _, err := url.Parse(config.Endpoint); err != nil {
+		return nil, errors.New("could not create S3 store, reason: invalid endpoint, " + err.Error())
+	}
+
+	region := config.Region
+
+	if region == "" {
+		region = DEFAULT_S3_REGION
+	}
+
+	formats := config.Formats
+
+	if len(formats) == 0 {
+		formats = DEFAULT_TILE_FORMATS
+	}
+
+	timeout := config.HttpClientTimeout
+
+	if timeout <= 0 {
+		timeout = DEFAULT_S3_HTTP_CLIENT_TIMEOUT
+	}
+
+	return &S3Store{
+		Endpoint:         strings.TrimSuffix(config.Endpoint, "/"),
+		Bucket:           config.Bucket,
+		Region:           region,
+		Prefix:           config.Prefix,
+		AccessKey:        config.AccessKey,
+		SecretKey:        config.SecretKey,
+		VirtualHostStyle: config.VirtualHostStyle,
+		Formats:          formats,
+		Client:           &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (s *S3Store) objectURL(key string, query url.Values) *url.URL {
+	u, _ := url.Parse(s.Endpoint)
+
+	if s.VirtualHostStyle {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+	} else {
+		u.Path = "/" + s.Bucket + "/" + key
+	}
+
+	if query != nil {
+		u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	}
+
+	return u
+}
+
+func (s *S3Store) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), bytes.NewReader(body))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	// only the path is escaped by url.URL, S3 expects all reserved characters
+	// of the key to be escaped
+	req.URL.RawPath = s3Escape(req.URL.Path, false)
+
+	signS3Request(req, sha256Hex(body), s.AccessKey, s.SecretKey, s.Region, time.Now())
+
+	resp, err := s.Client.Do(req)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return resp, respBody, os.ErrNotExist
+	case resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict:
+		return resp, respBody, errS3PreconditionFailed
+	case resp.StatusCode >= 300:
+		return resp, respBody, errors.New("S3 request " + method + " [" + key + "] failed with status " + strconv.Itoa(resp.StatusCode) + ": " + s3ErrorCode(respBody))
+	}
+
+	return resp, respBody, nil
+}
+
+func s3ErrorCode(body []byte) string {
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	if xml.Unmarshal(body, &s3Err) != nil || s3Err.Code == "" {
+		return "unknown error"
+	}
+
+	return s3Err.Code + " (" + s3Err.Message + ")"
+}
+
+func (s *S3Store) keyPrefix(route []string, params []string) string {
+	return s.Prefix + strings.Join(append(append([]string{}, route...), params...), "/") + "/"
+}
+
+func (s *S3Store) objectKey(key TileKey) string {
+	return s.keyPrefix(key.Route, key.Params) + key.Z + "/" + key.Y + "/" + key.X
+}
+
+// list returns the objects starting with prefix. If fn is set, it is called
+// for every page and the objects are not returned.
+func (s *S3Store) list(prefix string, fn func(objects []s3Object) error) ([]s3Object, error) {
+	objects := []s3Object{}
+	token := ""
+
+	for {
+		query := url.Values{
+			"list-type": []string{"2"},
+			"prefix":    []string{prefix},
+			"max-keys":  []string{strconv.Itoa(s3MaxKeys)},
+		}
+
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		_, body, err := s.do("GET", "", query, nil, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.Unmarshal(body, &result)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if fn != nil {
+			err = fn(result.Contents)
+
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			objects = append(objects, result.Contents...)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
+
+// objectKeys returns the keys a tile may be stored at, i.e. the tile in any of
+// the store's formats and its negative entry.
+func (s *S3Store) objectKeys(key TileKey) []string {
+	objectKey := s.objectKey(key)
+	keys := []string{}
+
+	for _, format := range s.Formats {
+		keys = append(keys, objectKey+format.Extension())
+	}
+
+	return append(keys, objectKey+TILE_META_SUFFIX)
+}
+
+func (s *S3Store) hasFormat(format TileFormat) bool {
+	for _, f := range s.Formats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+func s3MetaHeader(meta *TileMeta) http.Header {
+	header := http.Header{}
+
+	if meta == nil {
+		return header
+	}
+
+	header.Set(s3MetaFetchedAt, meta.FetchedAt.UTC().Format(time.RFC3339Nano))
+	header.Set(s3MetaOriginStatus, strconv.Itoa(meta.OriginStatus))
+	header.Set(s3MetaSize, strconv.Itoa(meta.Size))
+
+	values := map[string]string{
+		s3MetaETag:         meta.ETag,
+		s3MetaLastModified: meta.LastModified,
+		s3MetaOriginURL:    meta.OriginURL,
+		s3MetaChecksum:     meta.Checksum,
+	}
+
+	for name, value := range values {
+		if value != "" {
+			header.Set(name, url.QueryEscape(value))
+		}
+	}
+
+	return header
+}
+
+func parseS3Meta(header http.Header) *TileMeta {
+	fetchedAt, err := time.Parse(time.RFC3339Nano, header.Get(s3MetaFetchedAt))
+
+	if err != nil {
+		return nil
+	}
+
+	unescape := func(name string) string {
+		value, err := url.QueryUnescape(header.Get(name))
+		if err != nil {
+			return header.Get(name)
+		}
+		return value
+	}
+
+	status, _ := strconv.Atoi(header.Get(s3MetaOriginStatus))
+	size, _ := strconv.Atoi(header.Get(s3MetaSize))
+
+	return &TileMeta{
+		ContentType:  header.Get("Content-Type"),
+		ETag:         unescape(s3MetaETag),
+		LastModified: unescape(s3MetaLastModified),
+		FetchedAt:    fetchedAt,
+		OriginURL:    unescape(s3MetaOriginURL),
+		OriginStatus: status,
+		Size:         size,
+		Checksum:     unescape(s3MetaChecksum),
+	}
+}
+
+func (s *S3Store) Get(key TileKey) (*StoredTile, error) {
+	for _, format := range s.Formats {
+		resp, data, err := s.do("GET", s.objectKey(key)+format.Extension(), nil, nil, nil)
+
+		if err == os.ErrNotExist {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+		return &StoredTile{
+			Data:    data,
+			Format:  format,
+			Meta:    parseS3Meta(resp.Header),
+			ModTime: modTime,
+		}, nil
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// Put stores the tile conditionally. If another instance has stored a more
+// recent version of the tile in the meantime, the tile is discarded.
+func (s *S3Store) Put(key TileKey, tile *StoredTile) error {
+	objectKey := s.objectKey(key) + tile.Format.Extension()
+	contentType := tile.Format.ContentType()
+	body := tile.Data
+
+	if len(tile.Data) == 0 {
+		objectKey = s.objectKey(key) + TILE_META_SUFFIX
+		contentType = "application/json"
+
+		var err error
+		body, err = json.Marshal(tile.Meta)
+
+		if err != nil {
+			return err
+		}
+	} else if !s.hasFormat(tile.Format) {
+		return errors.New("could not store [" + key.String() + "], reason: format " + string(tile.Format) + " not in the store's Formats")
+	}
+
+	header := s3MetaHeader(tile.Meta)
+	header.Set("Content-Type", contentType)
+
+	resp, _, err := s.do("HEAD", objectKey, nil, nil, nil)
+
+	switch {
+	case err == os.ErrNotExist:
+		header.Set("If-None-Match", "*")
+	case err != nil:
+		return err
+	default:
+		if existing := parseS3Meta(resp.Header); existing != nil && tile.Meta != nil && existing.FetchedAt.After(tile.Meta.FetchedAt) {
+			return nil
+		}
+
+		header.Set("If-Match", resp.Header.Get("ETag"))
+	}
+
+	_, _, err = s.do("PUT", objectKey, nil, header, body)
+
+	if err == errS3PreconditionFailed {
+		// another instance has stored the tile in the meantime
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// the origin may have changed the tile's format, or the tile replaces a
+	// negative entry
+	others := []string{}
+	for _, other := range s.objectKeys(key) {
+		if other != objectKey {
+			others = append(others, other)
+		}
+	}
+
+	return s.deleteObjects(others)
+}
+
+// Touch replaces the metadata of a stored tile by copying the object onto
+// itself, the tile is not uploaded again. S3 sets the object's LastModified,
+// modTime is ignored. If the object has been replaced since it was stat'ed,
+// the more recent version is kept.
+func (s *S3Store) Touch(info TileInfo, modTime time.Time) error {
+	objectKey := s.objectKey(info.Key) + info.Format.Extension()
+
+	header := s3MetaHeader(info.Meta)
+	header.Set("Content-Type", info.Format.ContentType())
+	header.Set("X-Amz-Copy-Source", s3Escape("/"+s.Bucket+"/"+objectKey, false))
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+
+	if !info.ModTime.IsZero() {
+		header.Set("X-Amz-Copy-Source-If-Unmodified-Since", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	_, _, err := s.do("PUT", objectKey, nil, header, nil)
+
+	if err == errS3PreconditionFailed {
+		return nil
+	}
+
+	return err
+}
+
+func (s *S3Store) Delete(key TileKey) error {
+	return s.deleteObjects(s.objectKeys(key))
+}
+
+func (s *S3Store) deleteObjects(keys []string) error {
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > s3MaxKeys {
+			batch = batch[:s3MaxKeys]
+		}
+		keys = keys[len(batch):]
+
+		request := s3DeleteRequest{Quiet: true}
+		for _, key := range batch {
+			request.Objects = append(request.Objects, s3DeleteObject{Key: key})
+		}
+
+		body, err := xml.Marshal(request)
+
+		if err != nil {
+			return err
+		}
+
+		sum := md5.Sum(body)
+		header := http.Header{}
+		header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+		header.Set("Content-Type", "application/xml")
+
+		_, respBody, err := s.do("POST", "", url.Values{"delete": []string{""}}, header, body)
+
+		if err != nil {
+			return err
+		}
+
+		var result s3DeleteResult
+		if xml.Unmarshal(respBody, &result) == nil && len(result.Errors) > 0 {
+			return errors.New("could not delete [" + result.Errors[0].Key + "], reason: " + result.Errors[0].Code + " (" + result.Errors[0].Message + ")")
+		}
+	}
+
+	return nil
+}
+
+func (s *S3Store) Stat(key TileKey) (*TileInfo, error) {
+	for _, format := range append(append([]TileFormat{}, s.Formats...), "") {
+		objectKey := s.objectKey(key) + format.Extension()
+
+		if format == "" {
+			objectKey = s.objectKey(key) + TILE_META_SUFFIX
+		}
+
+		resp, _, err := s.do("HEAD", objectKey, nil, nil, nil)
+
+		if err == os.ErrNotExist {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var size int64 = 0
+		if format != "" {
+			size = resp.ContentLength
+		}
+
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+		return &TileInfo{
+			Key:     key,
+			Format:  format,
+			Size:    size,
+			ModTime: modTime,
+			Meta:    parseS3Meta(resp.Header),
+		}, nil
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// Iterate lists the route's objects page by page. Tiles are reported with the
+// object's LastModified as ModTime and without metadata, only negative entries
+// are read with an additional HEAD request.
+func (s *S3Store) Iterate(route []string, fn func(info TileInfo) error) error {
+	prefix := s.keyPrefix(route, nil)
+
+	var pending *TileInfo
+	pendingKey := ""
+
+	flush := func() error {
+		if pending == nil {
+			return nil
+		}
+
+		info := *pending
+		pending = nil
+
+		if info.Format == "" {
+			resp, _, err := s.do("HEAD", pendingKey+TILE_META_SUFFIX, nil, nil, nil)
+
+			if err == os.ErrNotExist {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			info.Meta = parseS3Meta(resp.Header)
+		}
+
+		return fn(info)
+	}
+
+	_, err := s.list(prefix, func(objects []s3Object) error {
+		for _, object := range objects {
+			name := path.Base(object.Key)
+			format := tileFileFormat(name)
+
+			if !isMetaFile(name) && format == "" {
+				continue
+			}
+
+			baseKey := path.Join(path.Dir(object.Key), tileFileKey(name))
+
+			if pending == nil || baseKey != pendingKey {
+				err := flush()
+
+				if err != nil {
+					return err
+				}
+
+				segments := strings.Split(strings.TrimPrefix(baseKey, prefix), "/")
+
+				if len(segments) < 3 {
+					continue
+				}
+
+				n := len(segments)
+				pending = &TileInfo{
+					Key: TileKey{
+						Route:  route,
+						Params: segments[:n-3],
+						Z:      segments[n-3],
+						Y:      segments[n-2],
+						X:      segments[n-1],
+					},
+					ModTime: object.LastModified,
+				}
+				pendingKey = baseKey
+			}
+
+			if !isMetaFile(name) {
+				pending.Format = format
+				pending.Size = object.Size
+				pending.ModTime = object.LastModified
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+// DeletePrefix removes all tiles of the route whose params start with params.
+func (s *S3Store) DeletePrefix(route []string, params []string) error {
+	_, err := s.list(s.keyPrefix(route, params), func(objects []s3Object) error {
+		keys := []string{}
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+		}
+
+		return s.deleteObjects(keys)
+	})
+
+	return err
+}
+
+// Clear removes all tiles of the route.
+func (s *S3Store) Clear(route []string) error {
+	return s.DeletePrefix(route, nil)
+}
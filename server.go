@@ -0,0 +1,247 @@
+package maptilecache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server owns a single listener and serves any number of caches, each under
+// its own route.
+type Server struct {
+	Host       string
+	Port       string
+	Logger     LoggerConfig
+	caches     map[string]*Cache
+	mutex      *sync.RWMutex
+	mux        *http.ServeMux
+	httpServer *http.Server
+}
+
+type ServerConfig struct {
+	Host        string
+	Port        string
+	DebugLogger func(string)
+	InfoLogger  func(string)
+	WarnLogger  func(string)
+	ErrorLogger func(string)
+}
+
+type RouteInfo struct {
+	Route       string `json:"route"`
+	UrlTemplate string `json:"urlTemplate"`
+	UrlScheme   string `json:"urlScheme"`
+}
+
+func NewServer(config ServerConfig) *Server {
+	s := Server{
+		Host:   config.Host,
+		Port:   config.Port,
+		caches: make(map[string]*Cache),
+		mutex:  &sync.RWMutex{},
+		mux:    http.NewServeMux(),
+		Logger: LoggerConfig{
+			LogPrefix:    "Server[" + config.Host + ":" + config.Port + "]",
+			LogDebugFunc: config.DebugLogger,
+			LogInfoFunc:  config.InfoLogger,
+			LogWarnFunc:  config.WarnLogger,
+			LogErrorFunc: config.ErrorLogger,
+		},
+	}
+
+	s.mux.HandleFunc("/", s.serveIndex)
+
+	return &s
+}
+
+func (s *Server) log(message string, logFunc func(string)) {
+	if logFunc != nil {
+		logFunc(s.Logger.LogPrefix + ": " + message)
+	}
+}
+
+func (s *Server) logDebug(message string) {
+	s.log(message, s.Logger.LogDebugFunc)
+}
+
+func (s *Server) logInfo(message string) {
+	s.log(message, s.Logger.LogInfoFunc)
+}
+
+func (s *Server) logWarn(message string) {
+	s.log(message, s.Logger.LogWarnFunc)
+}
+
+func (s *Server) logError(message string) {
+	s.log(message, s.Logger.LogErrorFunc)
+}
+
+// Register mounts the cache at "/" + c.RouteString + "/". It fails if the route
+// is already taken or if it is nested inside (or contains) another route.
+func (s *Server) Register(c *Cache) error {
+	if c == nil {
+		return errors.New("could not register cache, reason: cache is nil")
+	}
+
+	if len(c.Route) < 1 {
+		return errors.New("could not register cache, reason: route invalid, must have at least one entry")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for registeredRoute, registeredCache := range s.caches {
+		if routesConflict(c.Route, registeredCache.Route) {
+			msg := "could not register cache, reason: route [" + c.RouteString + "] conflicts with registered route [" + registeredRoute + "]"
+			s.logError(msg)
+			return errors.New(msg)
+		}
+	}
+
+	s.caches[c.RouteString] = c
+	s.mux.Handle("/"+c.RouteString+"/", c)
+
+	s.logInfo("Registered cache on route /" + c.RouteString + "/")
+
+	return nil
+}
+
+func routesConflict(a []string, b []string) bool {
+	shorter, longer := a, b
+	if len(shorter) > len(longer) {
+		shorter, longer = longer, shorter
+	}
+
+	for i := range shorter {
+		if shorter[i] != longer[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Routes returns the configured routes, sorted by route.
+func (s *Server) Routes() []RouteInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	routes := []RouteInfo{}
+	for route, c := range s.caches {
+		routes = append(routes, RouteInfo{
+			Route:       route,
+			UrlTemplate: "/" + route + "/{s}/{z}/{y}/{x}/",
+			UrlScheme:   c.UrlScheme,
+		})
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Route < routes[j].Route
+	})
+
+	return routes
+}
+
+func (s *Server) serveIndex(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	// do not expose api keys that are part of the url scheme
+	routes := s.Routes()
+	for i := range routes {
+		routes[i].UrlScheme = strings.Split(routes[i].UrlScheme, "?")[0]
+	}
+
+	body, err := json.Marshal(routes)
+
+	if err != nil {
+		s.logError("Could not serve index, reason: " + err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// ServeHTTP implements http.Handler, so the server's routes can also be
+// mounted on another server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(w, req)
+}
+
+// Start binds the listener and serves in the background. Errors binding the
+// listener are returned, errors while serving are logged.
+func (s *Server) Start() error {
+	start := time.Now()
+
+	if strings.TrimSpace(s.Port) == "" {
+		return errors.New("could not start server, reason: port not defined")
+	}
+
+	address := s.Host + ":" + s.Port
+	listener, err := net.Listen("tcp", address)
+
+	if err != nil {
+		s.logError("Could not listen on " + address + ", reason: " + err.Error())
+		return err
+	}
+
+	s.mutex.Lock()
+	s.httpServer = &http.Server{Handler: s}
+	httpServer := s.httpServer
+	s.mutex.Unlock()
+
+	go func() {
+		serveErr := httpServer.Serve(listener)
+
+		if serveErr != nil && serveErr != http.ErrServerClosed {
+			s.logError("Server on " + address + " stopped, reason: " + serveErr.Error())
+		}
+	}()
+
+	duration := time.Since(start)
+	s.logInfo("Server listening on " + address + " (took " + duration.String() + ")")
+
+	return nil
+}
+
+// ListenAndServe binds the listener and blocks until the server stops.
+func (s *Server) ListenAndServe() error {
+	address := s.Host + ":" + s.Port
+
+	s.mutex.Lock()
+	s.httpServer = &http.Server{Addr: address, Handler: s}
+	httpServer := s.httpServer
+	s.mutex.Unlock()
+
+	s.logInfo("Server listening on " + address)
+
+	return httpServer.ListenAndServe()
+}
+
+// Shutdown gracefully stops the listener and waits for in-flight requests to
+// finish. Registered caches are not closed, call Cache.Close for each of them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.RLock()
+	httpServer := s.httpServer
+	s.mutex.RUnlock()
+
+	if httpServer == nil {
+		return nil
+	}
+
+	s.logInfo("Shutting down server...")
+
+	return httpServer.Shutdown(ctx)
+}
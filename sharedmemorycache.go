@@ -1,15 +1,22 @@
 package maptilecache
 
 import (
+	"context"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 const MAX_SIZE_BYTES_UNLIMITED = -1
 
+type MemoryTile struct {
+	Data      []byte
+	Timestamp time.Time
+}
+
 type MemoryMap struct {
-	Tiles *map[string][]byte
+	Tiles *map[string]MemoryTile
 	Mutex *sync.RWMutex
 }
 
@@ -30,6 +37,9 @@ type SharedMemoryCache struct {
 	InfoLogger            func(string)
 	WarnLogger            func(string)
 	ErrorLogger           func(string)
+	closeOnce             *sync.Once
+	quit                  chan struct{}
+	done                  chan struct{}
 }
 
 type SharedMemoryCacheConfig struct {
@@ -53,6 +63,9 @@ func NewSharedMemoryCache(config SharedMemoryCacheConfig) *SharedMemoryCache {
 		InfoLogger:            config.InfoLogger,
 		WarnLogger:            config.WarnLogger,
 		ErrorLogger:           config.ErrorLogger,
+		closeOnce:             &sync.Once{},
+		quit:                  make(chan struct{}),
+		done:                  make(chan struct{}),
 	}
 
 	if m.MaxSizeBytes < 0 {
@@ -68,23 +81,41 @@ func NewSharedMemoryCache(config SharedMemoryCacheConfig) *SharedMemoryCache {
 
 	if m.EnsureMaxSizeInterval > 0 && m.MaxSizeBytes > 0 {
 		ticker := time.NewTicker(m.EnsureMaxSizeInterval)
-		quit := make(chan struct{})
 		go func() {
+			defer close(m.done)
 			for {
 				select {
 				case <-ticker.C:
 					m.EnsureMaxSize()
-				case <-quit:
+				case <-m.quit:
 					ticker.Stop()
 					return
 				}
 			}
 		}()
+	} else {
+		close(m.done)
 	}
 
 	return &m
 }
 
+// Close stops the background goroutine that enforces MaxSizeBytes. The cached
+// tiles remain readable.
+func (m *SharedMemoryCache) Close(ctx context.Context) error {
+	m.closeOnce.Do(func() {
+		close(m.quit)
+	})
+
+	select {
+	case <-m.done:
+		m.logDebug("Memory Cache closed.")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (m *SharedMemoryCache) log(message string, logFunc func(string)) {
 	if logFunc != nil {
 		logFunc(message)
@@ -117,7 +148,7 @@ func (m *SharedMemoryCache) addMemoryMapIfNotExists(mapKey string) *MemoryMap {
 	memoryMap := m.MemoryMaps[mapKey]
 
 	if memoryMap == nil {
-		newMap := make(map[string][]byte)
+		newMap := make(map[string]MemoryTile)
 		memoryMap = &MemoryMap{Tiles: &newMap, Mutex: &sync.RWMutex{}}
 		m.MemoryMaps[mapKey] = memoryMap
 		m.logDebug("Memory Map with key [" + mapKey + "] did not exist. Created map!")
@@ -126,13 +157,13 @@ func (m *SharedMemoryCache) addMemoryMapIfNotExists(mapKey string) *MemoryMap {
 	return memoryMap
 }
 
-func (mm *MemoryMap) getTile(tileKey string) (*[]byte, bool) {
-	data, exists := (*mm.Tiles)[tileKey]
-	return &data, exists
+func (mm *MemoryMap) getTile(tileKey string) (*MemoryTile, bool) {
+	tile, exists := (*mm.Tiles)[tileKey]
+	return &tile, exists
 }
 
-func (mm *MemoryMap) addTile(tileKey string, data *[]byte) {
-	(*mm.Tiles)[tileKey] = *data
+func (mm *MemoryMap) addTile(tileKey string, tile MemoryTile) {
+	(*mm.Tiles)[tileKey] = tile
 }
 
 func (mm *MemoryMap) removeTile(tileKey string) {
@@ -173,7 +204,7 @@ func (m *SharedMemoryCache) EnsureMaxSize() {
 		if deleteMapExisted {
 			deleteMemoryMap.Mutex.Lock()
 			deleteTile, _ := deleteMemoryMap.getTile(deleteKeys.TileKey)
-			deleteSize := len(*deleteTile)
+			deleteSize := len(deleteTile.Data)
 			m.SizeBytes -= deleteSize
 			deleteMemoryMap.removeTile(deleteKeys.TileKey)
 			deleteMemoryMap.Mutex.Unlock()
@@ -191,6 +222,18 @@ func (m *SharedMemoryCache) EnsureMaxSize() {
 }
 
 func (m *SharedMemoryCache) MemoryMapRead(mapKey string, tileKey string) (*[]byte, bool) {
+	tile, exists := m.MemoryMapReadTile(mapKey, tileKey)
+
+	if !exists {
+		return nil, false
+	}
+
+	return &tile.Data, true
+}
+
+// MemoryMapReadTile works like MemoryMapRead, but also returns the time the
+// tile was fetched from the origin.
+func (m *SharedMemoryCache) MemoryMapReadTile(mapKey string, tileKey string) (*MemoryTile, bool) {
 	m.MapMutes.RLock()
 	memoryMap, mapExists := m.getMemoryMap(mapKey)
 	m.MapMutes.RUnlock()
@@ -200,22 +243,32 @@ func (m *SharedMemoryCache) MemoryMapRead(mapKey string, tileKey string) (*[]byt
 	}
 
 	memoryMap.Mutex.RLock()
-	data, exists := memoryMap.getTile(tileKey)
+	tile, exists := memoryMap.getTile(tileKey)
 	memoryMap.Mutex.RUnlock()
 
-	return data, exists
+	if !exists {
+		return nil, false
+	}
+
+	return tile, true
 }
 
 func (m *SharedMemoryCache) MemoryMapWrite(mapKey string, tileKey string, data *[]byte) {
+	m.MemoryMapWriteTile(mapKey, tileKey, data, time.Now())
+}
+
+// MemoryMapWriteTile works like MemoryMapWrite, but stores the given timestamp
+// instead of the current time, e.g. the modtime of a tile loaded from disk.
+func (m *SharedMemoryCache) MemoryMapWriteTile(mapKey string, tileKey string, data *[]byte, timestamp time.Time) {
 	m.MapMutes.Lock()
 	memoryMap := m.addMemoryMapIfNotExists(mapKey)
 	m.MapMutes.Unlock()
 
 	memoryMap.Mutex.Lock()
-	prevData, _ := memoryMap.getTile(tileKey)
-	oldDataSize := len(*prevData)
+	prevTile, _ := memoryMap.getTile(tileKey)
+	oldDataSize := len(prevTile.Data)
 	newDataSize := len(*data)
-	memoryMap.addTile(tileKey, data)
+	memoryMap.addTile(tileKey, MemoryTile{Data: *data, Timestamp: timestamp})
 	memoryMap.Mutex.Unlock()
 
 	m.HistoryMutex.Lock()
@@ -224,3 +277,55 @@ func (m *SharedMemoryCache) MemoryMapWrite(mapKey string, tileKey string, data *
 	m.SizeBytes += newDataSize
 	m.HistoryMutex.Unlock()
 }
+
+// MemoryMapDelete removes a tile from the memory map, e.g. because the origin
+// no longer provides it.
+func (m *SharedMemoryCache) MemoryMapDelete(mapKey string, tileKey string) {
+	m.MapMutes.RLock()
+	memoryMap, mapExists := m.getMemoryMap(mapKey)
+	m.MapMutes.RUnlock()
+
+	if !mapExists {
+		return
+	}
+
+	memoryMap.Mutex.Lock()
+	tile, exists := memoryMap.getTile(tileKey)
+	size := len(tile.Data)
+	memoryMap.removeTile(tileKey)
+	memoryMap.Mutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	m.HistoryMutex.Lock()
+	m.SizeBytes -= size
+	m.HistoryMutex.Unlock()
+}
+
+// MemoryMapDeletePrefix removes all tiles whose key starts with prefix.
+func (m *SharedMemoryCache) MemoryMapDeletePrefix(mapKey string, prefix string) {
+	m.MapMutes.RLock()
+	memoryMap, mapExists := m.getMemoryMap(mapKey)
+	m.MapMutes.RUnlock()
+
+	if !mapExists {
+		return
+	}
+
+	size := 0
+
+	memoryMap.Mutex.Lock()
+	for tileKey, tile := range *memoryMap.Tiles {
+		if strings.HasPrefix(tileKey, prefix) {
+			size += len(tile.Data)
+			memoryMap.removeTile(tileKey)
+		}
+	}
+	memoryMap.Mutex.Unlock()
+
+	m.HistoryMutex.Lock()
+	m.SizeBytes -= size
+	m.HistoryMutex.Unlock()
+}
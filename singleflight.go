@@ -0,0 +1,178 @@
+package maptilecache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type flightCall struct {
+	done   chan struct{}
+	result *fetchResult
+	err    error
+	ctx    *flightContext
+}
+
+// flightContext is the context a coalesced call runs on. It is derived from
+// the cache's background context and only cancelled once every caller waiting
+// for the call has given up. Its deadline is the latest deadline of the
+// remaining callers, so the call is allowed to take as long as any of them
+// still waits.
+type flightContext struct {
+	context.Context
+	cancel  context.CancelFunc
+	mutex   *sync.Mutex
+	nextId  int
+	waiters map[int]context.Context
+}
+
+func newFlightContext(parent context.Context) *flightContext {
+	ctx, cancel := context.WithCancel(parent)
+
+	return &flightContext{
+		Context: ctx,
+		cancel:  cancel,
+		mutex:   &sync.Mutex{},
+		waiters: make(map[int]context.Context),
+	}
+}
+
+func (f *flightContext) join(ctx context.Context) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.nextId++
+	f.waiters[f.nextId] = ctx
+
+	return f.nextId
+}
+
+// leave returns the number of remaining waiters.
+func (f *flightContext) leave(id int) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	delete(f.waiters, id)
+
+	return len(f.waiters)
+}
+
+func (f *flightContext) Deadline() (time.Time, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var latest time.Time
+
+	for _, waiter := range f.waiters {
+		deadline, ok := waiter.Deadline()
+
+		if !ok {
+			return f.Context.Deadline()
+		}
+
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+
+	if latest.IsZero() {
+		return f.Context.Deadline()
+	}
+
+	return latest, true
+}
+
+// flightGroup collapses concurrent calls with the same key into a single
+// execution, every caller receives the result of that execution.
+type flightGroup struct {
+	mutex *sync.Mutex
+	calls map[string]*flightCall
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		mutex: &sync.Mutex{},
+		calls: make(map[string]*flightCall),
+	}
+}
+
+// do executes fn on a context derived from parent unless a call for key is
+// already in flight, in which case it joins that call and returns its result
+// with shared set to true. Every caller waits until the call is done or its
+// own ctx is done. fn is only cancelled once all callers have given up.
+func (g *flightGroup) do(ctx context.Context, parent context.Context, key string, fn func(ctx context.Context) (*fetchResult, error)) (result *fetchResult, err error, shared bool) {
+	g.mutex.Lock()
+
+	call, shared := g.calls[key]
+
+	if !shared {
+		call = &flightCall{
+			done: make(chan struct{}),
+			ctx:  newFlightContext(parent),
+		}
+		g.calls[key] = call
+	}
+
+	id := call.ctx.join(ctx)
+	g.mutex.Unlock()
+
+	if !shared {
+		go g.run(key, call, fn)
+	}
+
+	select {
+	case <-call.done:
+		call.ctx.leave(id)
+		return call.result, call.err, shared
+	case <-ctx.Done():
+		g.mutex.Lock()
+		if call.ctx.leave(id) == 0 {
+			// nobody waits for the result anymore, later callers start over
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			call.ctx.cancel()
+		}
+		g.mutex.Unlock()
+
+		return nil, ctx.Err(), shared
+	}
+}
+
+func (g *flightGroup) run(key string, call *flightCall, fn func(ctx context.Context) (*fetchResult, error)) {
+	result, err := fn(call.ctx)
+
+	g.mutex.Lock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	g.mutex.Unlock()
+
+	call.result, call.err = result, err
+	close(call.done)
+	call.ctx.cancel()
+}
+
+// doAsync executes fn on a context derived from parent in a new goroutine
+// unless a call for key is already in flight. It reports whether fn was
+// started. Callers joining the call with do cannot cancel it.
+func (g *flightGroup) doAsync(parent context.Context, key string, fn func(ctx context.Context) (*fetchResult, error)) bool {
+	g.mutex.Lock()
+
+	if _, exists := g.calls[key]; exists {
+		g.mutex.Unlock()
+		return false
+	}
+
+	call := &flightCall{
+		done: make(chan struct{}),
+		ctx:  newFlightContext(parent),
+	}
+	call.ctx.join(context.Background())
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	go g.run(key, call, fn)
+
+	return true
+}
@@ -0,0 +1,101 @@
+package maptilecache
+
+import (
+	"bytes"
+	"strings"
+)
+
+type TileFormat string
+
+const (
+	TILE_FORMAT_PNG  TileFormat = "png"
+	TILE_FORMAT_JPEG TileFormat = "jpeg"
+	TILE_FORMAT_WEBP TileFormat = "webp"
+	TILE_FORMAT_MVT  TileFormat = "mvt"
+)
+
+var DEFAULT_TILE_FORMATS = []TileFormat{TILE_FORMAT_PNG}
+
+var allTileFormats = []TileFormat{TILE_FORMAT_PNG, TILE_FORMAT_JPEG, TILE_FORMAT_WEBP, TILE_FORMAT_MVT}
+
+func (f TileFormat) Extension() string {
+	switch f {
+	case TILE_FORMAT_PNG:
+		return ".png"
+	case TILE_FORMAT_JPEG:
+		return ".jpg"
+	case TILE_FORMAT_WEBP:
+		return ".webp"
+	case TILE_FORMAT_MVT:
+		return ".pbf"
+	}
+
+	return ".tile"
+}
+
+func (f TileFormat) ContentType() string {
+	switch f {
+	case TILE_FORMAT_PNG:
+		return "image/png"
+	case TILE_FORMAT_JPEG:
+		return "image/jpeg"
+	case TILE_FORMAT_WEBP:
+		return "image/webp"
+	case TILE_FORMAT_MVT:
+		return "application/vnd.mapbox-vector-tile"
+	}
+
+	return "application/octet-stream"
+}
+
+func isGzipped(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// sniffTileFormat detects the format of a tile by its magic bytes. Vector
+// tiles have no magic bytes, they are recognized if they are gzipped, start
+// with a layer field or if the origin declared them as protobuf.
+func sniffTileFormat(data []byte, contentType string) (TileFormat, bool) {
+	switch {
+	case len(data) >= 4 && strings.ToLower(string(data[1:4])) == "png":
+		return TILE_FORMAT_PNG, true
+	case len(data) >= 3 && data[0] == 0xff && data[1] == 0xd8 && data[2] == 0xff:
+		return TILE_FORMAT_JPEG, true
+	case len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return TILE_FORMAT_WEBP, true
+	case isGzipped(data):
+		return TILE_FORMAT_MVT, true
+	case len(data) >= 1 && data[0] == 0x1a:
+		return TILE_FORMAT_MVT, true
+	}
+
+	contentType = strings.ToLower(contentType)
+	if strings.Contains(contentType, "protobuf") || strings.Contains(contentType, "vector-tile") {
+		return TILE_FORMAT_MVT, true
+	}
+
+	return "", false
+}
+
+func (c *Cache) acceptsFormat(format TileFormat) bool {
+	for _, accepted := range c.TileFormats {
+		if accepted == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contentType returns the Content-Type for a cached tile.
+func (c *Cache) contentType(data []byte) string {
+	if format, known := sniffTileFormat(data, ""); known {
+		return format.ContentType()
+	}
+
+	if len(c.TileFormats) == 1 {
+		return c.TileFormats[0].ContentType()
+	}
+
+	return "application/octet-stream"
+}
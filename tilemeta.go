@@ -0,0 +1,90 @@
+package maptilecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TILE_META_SUFFIX = ".meta.json"
+
+// TileMeta describes a cached tile. It is stored in a sidecar file next to the
+// tile, {x}.meta.json for the tile {x}.png (or any other format's extension).
+type TileMeta struct {
+	ContentType  string    `json:"contentType,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+	OriginURL    string    `json:"originUrl,omitempty"`
+	OriginStatus int       `json:"originStatus,omitempty"`
+	Size         int       `json:"size"`
+	Checksum     string    `json:"checksum,omitempty"`
+}
+
+func newTileMeta(data []byte, resp *originResponse, contentType string, originURL string) *TileMeta {
+	return &TileMeta{
+		ContentType:  contentType,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		FetchedAt:    time.Now(),
+		OriginURL:    originURL,
+		OriginStatus: resp.StatusCode,
+		Size:         len(data),
+		Checksum:     checksum(data),
+	}
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Verify checks the tile's data against the recorded size and checksum, e.g.
+// to detect truncated files.
+func (m *TileMeta) Verify(data []byte) error {
+	if m.Size != len(data) {
+		return errors.New("Tile size mismatch, expected " + strconv.Itoa(m.Size) + " Bytes, got " + strconv.Itoa(len(data)) + " Bytes")
+	}
+
+	if m.Checksum != "" && m.Checksum != checksum(data) {
+		return errors.New("Tile checksum mismatch")
+	}
+
+	return nil
+}
+
+func isMetaFile(path string) bool {
+	return strings.HasSuffix(path, TILE_META_SUFFIX)
+}
+
+func readTileMeta(metaPath string) (*TileMeta, error) {
+	data, err := ioutil.ReadFile(metaPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var meta TileMeta
+	err = json.Unmarshal(data, &meta)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+// tileTimestamp returns the time the tile was fetched from the origin. Tiles
+// cached without metadata fall back to the file's modtime.
+func tileTimestamp(meta *TileMeta, modtime time.Time) time.Time {
+	if meta == nil || meta.FetchedAt.IsZero() {
+		return modtime
+	}
+
+	return meta.FetchedAt
+}
@@ -0,0 +1,82 @@
+package maptilecache
+
+import (
+	"strings"
+	"time"
+)
+
+// TileKey identifies a tile. Params holds the values of the cache's
+// StructureParams that were set on the request, in the configured order.
+type TileKey struct {
+	Route  []string
+	Params []string
+	Z      string
+	Y      string
+	X      string
+}
+
+func (k TileKey) String() string {
+	parts := append([]string{}, k.Route...)
+	parts = append(parts, k.Params...)
+	parts = append(parts, k.Z, k.Y, k.X)
+
+	return strings.Join(parts, "/")
+}
+
+// StoredTile is a tile as it is kept in a TileStore. A tile without Data only
+// consists of its metadata, e.g. a negative entry.
+type StoredTile struct {
+	Data    []byte
+	Format  TileFormat
+	Meta    *TileMeta
+	ModTime time.Time
+}
+
+// TileInfo describes a stored tile without its data. Format is empty and Size
+// is 0 if only metadata is stored for the key.
+type TileInfo struct {
+	Key     TileKey
+	Format  TileFormat
+	Size    int64
+	ModTime time.Time
+	Meta    *TileMeta
+}
+
+// TileStore persists tiles. Get and Stat return an error satisfying
+// os.IsNotExist if nothing is stored for the key. Put replaces the tile
+// including its metadata, regardless of the format stored before. Iterate
+// calls fn for every key stored below route and stops at the first error.
+//
+// Stores may additionally implement Clear(route []string) error to remove all
+// tiles of a route at once, it is used by Cache.WipeCache, and
+// DeletePrefix(route []string, params []string) error to remove all tiles whose
+// params start with params, it is used by Cache.PurgeParams. Stores that may
+// leave temp files behind after a crash implement
+// RemoveTempFiles(route []string, stop <-chan struct{}) (int, error), it is
+// run in the background when a cache is created. Stores that can update a
+// tile's metadata without rewriting its data implement
+// Touch(info TileInfo, modTime time.Time) error, it is used when the origin
+// confirms a cached tile with 304 Not Modified.
+type TileStore interface {
+	Get(key TileKey) (*StoredTile, error)
+	Put(key TileKey, tile *StoredTile) error
+	Delete(key TileKey) error
+	Stat(key TileKey) (*TileInfo, error)
+	Iterate(route []string, fn func(info TileInfo) error) error
+}
+
+type tileStoreClearer interface {
+	Clear(route []string) error
+}
+
+type tileStorePrefixDeleter interface {
+	DeletePrefix(route []string, params []string) error
+}
+
+type tileStoreTempFileRemover interface {
+	RemoveTempFiles(route []string, stop <-chan struct{}) (int, error)
+}
+
+type tileStoreToucher interface {
+	Touch(info TileInfo, modTime time.Time) error
+}
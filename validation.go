@@ -0,0 +1,216 @@
+package maptilecache
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// number of errors kept in a ValidationReport, further errors are only counted
+const maxValidationReportErrors = 100
+
+var errValidationPaused = errors.New("validation batch complete")
+
+// ValidationReport summarizes a run of ValidateCache.
+type ValidationReport struct {
+	Started        time.Time
+	Duration       time.Duration
+	Scanned        int   // tiles inspected in this run
+	Removed        int   // tiles removed because they were outdated or broken
+	BytesScanned   int64 // size of the inspected tiles
+	BytesReclaimed int64 // size of the removed tiles
+	Errors         []error
+	ErrorCount     int  // all errors, Errors only holds the first maxValidationReportErrors
+	Resumed        bool // the run continued where the previous run stopped
+	Complete       bool // the run reached the end of the cache, the next run starts from the beginning
+}
+
+func (r *ValidationReport) addError(err error) {
+	r.ErrorCount++
+
+	if len(r.Errors) < maxValidationReportErrors {
+		r.Errors = append(r.Errors, err)
+	}
+}
+
+func (r ValidationReport) String() string {
+	return fmt.Sprintf("%d tiles scanned (%d Bytes), %d tiles removed (%d Bytes reclaimed), %d errors, complete: %t, took %s",
+		r.Scanned, r.BytesScanned, r.Removed, r.BytesReclaimed, r.ErrorCount, r.Complete, r.Duration.String())
+}
+
+// validationState keeps the position of an incomplete validation pass between
+// runs. mutex is held for a whole run, lastReport has its own lock so it can
+// be read while a run is in progress.
+type validationState struct {
+	mutex       *sync.Mutex
+	offset      int
+	reportMutex *sync.RWMutex
+	lastReport  *ValidationReport
+}
+
+func newValidationState() *validationState {
+	return &validationState{
+		mutex:       &sync.Mutex{},
+		reportMutex: &sync.RWMutex{},
+	}
+}
+
+// ValidateCache removes outdated tiles, tiles that do not match their metadata
+// and expired negative entries from the store. A run inspects at most
+// ValidationBatchSize tiles at ValidationTilesPerSecond, the next run
+// continues where it stopped. The position is kept as the number of tiles
+// kept so far, tiles stored in the meantime may therefore be skipped or
+// inspected twice until the next pass.
+func (c *Cache) ValidateCache() ValidationReport {
+	c.validation.mutex.Lock()
+	defer c.validation.mutex.Unlock()
+
+	report := ValidationReport{
+		Started: time.Now(),
+		Resumed: c.validation.offset > 0,
+	}
+
+	if report.Resumed {
+		c.logInfo("Validating cache, resuming after " + strconv.Itoa(c.validation.offset) + " tiles...")
+	} else {
+		c.logInfo("Validating cache...")
+	}
+
+	limiter := newOriginLimiter(0, c.ValidationTilesPerSecond, 1)
+	skip := c.validation.offset
+	kept := c.validation.offset
+
+	err := c.Store.Iterate(c.Route, func(info TileInfo) error {
+		if skip > 0 {
+			skip--
+			return nil
+		}
+
+		if c.ValidationBatchSize > 0 && report.Scanned >= c.ValidationBatchSize {
+			return errValidationPaused
+		}
+
+		// stops the run when the cache is closed
+		err := c.backgroundCtx.Err()
+
+		if err == nil {
+			err = limiter.acquire(c.backgroundCtx)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		report.Scanned++
+		report.BytesScanned += info.Size
+
+		key := info.Key.String()
+		reason := c.invalidReason(info)
+
+		if reason == "" {
+			kept++
+			return nil
+		}
+
+		c.logDebug("[" + key + "] " + reason + ". Removing tile from cache...")
+
+		err = c.Store.Delete(info.Key)
+
+		if err != nil {
+			c.logWarn("Could not remove [" + key + "], reason: " + err.Error())
+			report.addError(errors.New("could not remove [" + key + "], reason: " + err.Error()))
+			kept++
+			return nil
+		}
+
+		c.quota.remove(key)
+		report.Removed++
+		report.BytesReclaimed += info.Size
+
+		return nil
+	})
+
+	switch err {
+	case nil:
+		report.Complete = true
+		c.validation.offset = 0
+	case errValidationPaused:
+		c.validation.offset = kept
+	default:
+		c.logWarn("Could not validate cache, reason: " + err.Error())
+		report.addError(err)
+		c.validation.offset = kept
+	}
+
+	report.Duration = time.Since(report.Started)
+
+	c.validation.reportMutex.Lock()
+	c.validation.lastReport = &report
+	c.validation.reportMutex.Unlock()
+
+	c.logInfo("Cache validated: " + report.String())
+
+	return report
+}
+
+// invalidReason returns why a stored tile has to be removed, or an empty
+// string if it is kept.
+func (c *Cache) invalidReason(info TileInfo) string {
+	if info.Format == "" {
+		// metadata without a tile, only current negative entries are kept
+		if info.Meta != nil && info.Meta.IsNegative() && c.isNegativeEntryCurrent(info.Meta.FetchedAt) {
+			return ""
+		}
+
+		return "has no tile"
+	}
+
+	timestamp := tileTimestamp(info.Meta, info.ModTime)
+
+	if info.Meta != nil && int64(info.Meta.Size) != info.Size {
+		return "does not match the size recorded in its metadata"
+	}
+
+	if c.isFileOutdated(timestamp) && !c.isStaleUsable(timestamp) {
+		return "is outdated"
+	}
+
+	return ""
+}
+
+// LastValidationReport returns the report of the most recent run of
+// ValidateCache, or nil if it has not run yet.
+func (c *Cache) LastValidationReport() *ValidationReport {
+	c.validation.reportMutex.RLock()
+	defer c.validation.reportMutex.RUnlock()
+
+	return c.validation.lastReport
+}
+
+// initValidationRunner runs ValidateCache every ValidationInterval.
+func (c *Cache) initValidationRunner() {
+	if c.ValidationInterval <= 0 {
+		c.logDebug("Will not validate cache periodically, reason: ValidationInterval not set")
+		return
+	}
+
+	c.inFlight.Add(1)
+
+	go func() {
+		defer c.inFlight.Done()
+
+		ticker := time.NewTicker(c.ValidationInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.ValidateCache()
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,144 @@
+package maptilecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// TileValidator decides whether a tile received from the origin may be cached
+// and served. format is the format detected by the tile's magic bytes.
+type TileValidator interface {
+	Validate(data []byte, format TileFormat) error
+}
+
+// TileValidatorFunc adapts a function to the TileValidator interface.
+type TileValidatorFunc func(data []byte, format TileFormat) error
+
+func (f TileValidatorFunc) Validate(data []byte, format TileFormat) error {
+	return f(data, format)
+}
+
+// ValidatorChain runs validators in order and fails on the first error.
+type ValidatorChain []TileValidator
+
+func (chain ValidatorChain) Validate(data []byte, format TileFormat) error {
+	for _, validator := range chain {
+		if validator == nil {
+			continue
+		}
+
+		err := validator.Validate(data, format)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ChainValidators(validators ...TileValidator) TileValidator {
+	return ValidatorChain(validators)
+}
+
+// MagicByteValidator checks the complete file signature of the tile's format.
+// Vector tiles have no signature and always pass.
+type MagicByteValidator struct{}
+
+func (v MagicByteValidator) Validate(data []byte, format TileFormat) error {
+	var signature []byte
+
+	switch format {
+	case TILE_FORMAT_PNG:
+		signature = []byte("\x89PNG\r\n\x1a\n")
+	case TILE_FORMAT_JPEG:
+		signature = []byte{0xff, 0xd8, 0xff}
+	case TILE_FORMAT_WEBP:
+		if len(data) < 12 || !bytes.Equal(data[8:12], []byte("WEBP")) {
+			return errors.New("tile has no WebP signature")
+		}
+		signature = []byte("RIFF")
+	default:
+		return nil
+	}
+
+	if !bytes.HasPrefix(data, signature) {
+		return errors.New("tile has no " + string(format) + " signature")
+	}
+
+	return nil
+}
+
+// DecodeValidator fully decodes PNG and JPEG tiles and decompresses gzipped
+// vector tiles, which catches truncated or otherwise corrupt tiles. Other
+// formats pass.
+type DecodeValidator struct{}
+
+func (v DecodeValidator) Validate(data []byte, format TileFormat) error {
+	var err error
+
+	switch format {
+	case TILE_FORMAT_PNG:
+		_, err = png.Decode(bytes.NewReader(data))
+	case TILE_FORMAT_JPEG:
+		_, err = jpeg.Decode(bytes.NewReader(data))
+	case TILE_FORMAT_MVT:
+		if isGzipped(data) {
+			var reader *gzip.Reader
+			reader, err = gzip.NewReader(bytes.NewReader(data))
+
+			if err == nil {
+				_, err = io.Copy(ioutil.Discard, reader)
+			}
+		}
+	}
+
+	if err != nil {
+		return errors.New("tile could not be decoded, reason: " + err.Error())
+	}
+
+	return nil
+}
+
+// MinSizeValidator rejects tiles smaller than MinBytes.
+type MinSizeValidator struct {
+	MinBytes int
+}
+
+func (v MinSizeValidator) Validate(data []byte, format TileFormat) error {
+	if len(data) < v.MinBytes {
+		return errors.New("tile too small, got " + strconv.Itoa(len(data)) + " Bytes, expected at least " + strconv.Itoa(v.MinBytes) + " Bytes")
+	}
+
+	return nil
+}
+
+// BlankTileValidator rejects tiles whose SHA-256 checksum is listed in
+// Checksums, e.g. "no data" placeholders. Checksums are hex encoded, optionally
+// prefixed with "sha256:" as in TileMeta.Checksum.
+type BlankTileValidator struct {
+	Checksums []string
+}
+
+func (v BlankTileValidator) Validate(data []byte, format TileFormat) error {
+	sum := checksum(data)
+
+	for _, blank := range v.Checksums {
+		if !strings.HasPrefix(blank, "sha256:") {
+			blank = "sha256:" + blank
+		}
+
+		if strings.EqualFold(sum, blank) {
+			return errors.New("tile is a known blank tile (" + sum + ")")
+		}
+	}
+
+	return nil
+}
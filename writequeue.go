@@ -0,0 +1,148 @@
+package maptilecache
+
+import (
+	"sync"
+	"time"
+)
+
+const DEFAULT_WRITE_WORKERS = 4
+const DEFAULT_WRITE_QUEUE_SIZE = 1000
+
+type WriteQueuePolicy int
+
+const (
+	WRITE_QUEUE_BLOCK WriteQueuePolicy = iota // wait for a free slot, slows down requests to the origin
+	WRITE_QUEUE_DROP                          // do not persist the tile, it is still served from memory
+)
+
+type writeJob struct {
+	enqueued time.Time
+	write    func() error
+}
+
+// writeQueue persists tiles with a fixed number of workers. Jobs that do not
+// fit into the queue either block the caller or are dropped, depending on the
+// policy.
+type writeQueue struct {
+	jobs    chan writeJob
+	policy  WriteQueuePolicy
+	workers *sync.WaitGroup
+	mutex   *sync.RWMutex
+	closed  bool
+}
+
+func newWriteQueue(size int, policy WriteQueuePolicy) *writeQueue {
+	if size <= 0 {
+		size = DEFAULT_WRITE_QUEUE_SIZE
+	}
+
+	return &writeQueue{
+		jobs:    make(chan writeJob, size),
+		policy:  policy,
+		workers: &sync.WaitGroup{},
+		mutex:   &sync.RWMutex{},
+	}
+}
+
+// start runs the workers, done is called after every job.
+func (q *writeQueue) start(workers int, done func(job writeJob, err error)) {
+	if workers <= 0 {
+		workers = DEFAULT_WRITE_WORKERS
+	}
+
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+
+		go func() {
+			defer q.workers.Done()
+
+			for job := range q.jobs {
+				done(job, job.write())
+			}
+		}()
+	}
+}
+
+// enqueue returns false if the job was dropped because the queue is full or
+// closed.
+func (q *writeQueue) enqueue(job writeJob) bool {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	if q.closed {
+		return false
+	}
+
+	if q.policy == WRITE_QUEUE_BLOCK {
+		q.jobs <- job
+		return true
+	}
+
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops accepting jobs. The workers exit once the queue is drained.
+func (q *writeQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	q.closed = true
+	close(q.jobs)
+}
+
+func (q *writeQueue) length() int {
+	return len(q.jobs)
+}
+
+func (q *writeQueue) capacity() int {
+	return cap(q.jobs)
+}
+
+// persist queues a write to the store. The write is responsible for logging
+// its own errors.
+func (c *Cache) persist(requestIdPrefix string, write func() error) {
+	queued := c.writes.enqueue(writeJob{
+		enqueued: time.Now(),
+		write:    write,
+	})
+
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+
+	if !queued {
+		c.Stats.WritesDropped++
+		c.logWarn(requestIdPrefix + "Write queue full or closed, tile will not be persisted.")
+		return
+	}
+
+	if length := c.writes.length(); length > c.Stats.MaxWriteQueueLength {
+		c.Stats.MaxWriteQueueLength = length
+	}
+}
+
+func (c *Cache) writeDone(job writeJob, err error) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+
+	if err != nil {
+		c.Stats.WritesFailed++
+	} else {
+		c.Stats.WritesCompleted++
+	}
+
+	c.Stats.WriteLatency += time.Since(job.enqueued)
+}
+
+// WriteQueueLength returns the number of tiles waiting to be persisted.
+func (c *Cache) WriteQueueLength() int {
+	return c.writes.length()
+}